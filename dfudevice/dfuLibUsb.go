@@ -1,102 +1,231 @@
+//go:build linux && cgo
+// +build linux,cgo
+
 package dfudevice
 
 import (
 	"fmt"
-	"log"
+	"strconv"
+	"strings"
 
 	"github.com/google/gousb"
 )
 
 type dfulibusb struct {
 	*gousb.Device
-	ctx *gousb.Context
+	ctx  *gousb.Context
+	cfg  *gousb.Config
+	intf *gousb.Interface
 }
 
 func init() {
-	// TODO: Change list string to return the value for Open()
-	//var d dfulibusb
-	//addDriver(&d)
+	var d dfulibusb
+	addDriver(&d)
 }
 
-func (d dfulibusb) Open(path string) (dfuDevice DFUDevice, err error) {
-	var vid, pid uint16
+// usbPath names a device by bus and port chain, e.g. "1-2.3", the same form
+// used by sysfs. Unlike the device address it survives a re-enumeration.
+func usbPath(desc *gousb.DeviceDesc) string {
+	ports := make([]string, len(desc.Path))
+	for idx, port := range desc.Path {
+		ports[idx] = strconv.Itoa(port)
+	}
+	return fmt.Sprintf("%d-%s", desc.Bus, strings.Join(ports, "."))
+}
+
+// findDFUInterface returns the configuration and interface number of the
+// first interface of desc using protocol (runtime or DFU mode)
+func findDFUInterface(desc *gousb.DeviceDesc, protocol gousb.Protocol) (cfgNum, intfNum int, found bool) {
+	for _, cfg := range desc.Configs {
+		for _, intf := range cfg.Interfaces {
+			for _, alt := range intf.AltSettings {
+				if alt.Class == usbClassApplication && alt.SubClass == usbSubClassDFU && alt.Protocol == protocol {
+					return cfg.Number, intf.Number, true
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+func (d dfulibusb) Open(path string) (DFUDevice, error) {
+	return libusbOpen(path, usbProtocolDFU)
+}
+
+func (d dfulibusb) OpenRuntime(path string) (DFUDevice, error) {
+	return libusbOpen(path, usbProtocolRuntime)
+}
+
+func libusbOpen(path string, protocol gousb.Protocol) (dfuDevice DFUDevice, err error) {
 	// Initialize a new Context.
 	ctx := gousb.NewContext()
 
-	// Open any device with a given VID/PID using a convenience function.
+	var cfgNum, intfNum int
 	var found bool
 	devs, err := ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
-		if found {
+		if found || usbPath(desc) != path {
 			return false
 		}
-		if desc.Vendor == gousb.ID(vid) && desc.Product == gousb.ID(pid) {
-			found = true
-			return true
-		}
-		return false
+		cfgNum, intfNum, found = findDFUInterface(desc, protocol)
+		return found
 	})
 
-	//TODO: sometimes this throws an unrelated error even if its not related to this particular device
-	//ignore for now as another call below will error if there is truly an error
-	//if err != nil {
-	//	return err
-	//}
-
+	//OpenDevices can report errors for unrelated devices it failed to
+	//open, only fail if the requested device was not opened
 	if len(devs) == 0 {
-		err = fmt.Errorf("No DFU Device Found")
-		return
-	} else if len(devs) > 1 {
-		err = fmt.Errorf("More than 1 DFU device found")
+		ctx.Close()
+		if err == nil {
+			err = fmt.Errorf("No DFU Device Found at %s", path)
+		}
 		return
 	}
 
-	device := &dfulibusb{devs[0], ctx}
+	device := &dfulibusb{Device: devs[0], ctx: ctx}
 	device.ControlTimeout = 5000000000 //5s
 
-	//TODO: This should find the correct interface if possible
-	// Claim the default interface
-	_, done, err := device.DefaultInterface()
+	err = device.SetAutoDetach(true)
 	if err != nil {
-		log.Fatalf("%s.DefaultInterface(): %v", device, err)
+		device.Close()
+		return dfuDevice, fmt.Errorf("%s.SetAutoDetach(): %v", path, err)
 	}
 
-	defer done()
+	device.cfg, err = device.Config(cfgNum)
+	if err != nil {
+		device.Close()
+		return dfuDevice, fmt.Errorf("%s.Config(%d): %v", path, cfgNum, err)
+	}
+
+	device.intf, err = device.cfg.Interface(intfNum, 0)
+	if err != nil {
+		device.Close()
+		return dfuDevice, fmt.Errorf("%s.Interface(%d, 0): %v", path, intfNum, err)
+	}
 
 	dfuDevice.dev = device
+	dfuDevice.cfgNum = cfgNum
+	dfuDevice.intfNum = intfNum
+
+	//Runtime interfaces only have to support DETACH
+	if protocol == usbProtocolRuntime {
+		return
+	}
+
 	err = dfuDevice.ClearStatus()
 
+	if err != nil {
+		device.Close()
+		dfuDevice.dev = nil
+	}
+
 	return
 }
 
-func (d *dfulibusb) List() []string {
-	var VID, PID uint
+func (d *dfulibusb) List(filter DeviceFilter) []string {
+	return libusbList(filter, usbProtocolDFU)
+}
+
+func (d *dfulibusb) ListRuntime(filter DeviceFilter) []string {
+	return libusbList(filter, usbProtocolRuntime)
+}
+
+func libusbList(filter DeviceFilter, protocol gousb.Protocol) []string {
 	devices := make([]string, 0)
 	ctx := gousb.NewContext()
 	defer ctx.Close()
 
-	devs, _ := ctx.OpenDevices(func(d *gousb.DeviceDesc) bool {
-		if (d.Vendor == gousb.ID(VID)) && (d.Product == gousb.ID(PID)) {
-			devices = append(devices, fmt.Sprintf("DFU Device Bus: %d.%d ID: %s:%s", d.Bus, d.Address, d.Vendor, d.Product))
-			return true
+	//Only descriptors are needed, never open anything
+	ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
+		if !filter.matches(uint16(desc.Vendor), uint16(desc.Product)) {
+			return false
+		}
+
+		if _, _, found := findDFUInterface(desc, protocol); found {
+			devices = append(devices, usbPath(desc))
 		}
 		return false
 	})
 
-	// All Devices returned from OpenDevices must be closed.
-	defer func() {
-		for _, d := range devs {
-			d.Close()
+	return devices
+}
+
+func (d *dfulibusb) Enumerate(filter DeviceFilter) ([]DeviceInfo, error) {
+	//Paths are the sysfs device names, which carry the serial number without
+	//having to open every device
+	return sysfsEnumerate(filter), nil
+}
+
+func (d *dfulibusb) Control(rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	n, err := d.Device.Control(rType, request, val, idx, data)
+
+	switch err {
+	case gousb.ErrorNoDevice:
+		return n, errNoDevice
+	case gousb.ErrorPipe:
+		return n, errPipe
+	}
+	return n, err
+}
+
+func (d *dfulibusb) SetAltSetting(intfNum, altNum int) error {
+	var err error
+
+	if d.intf != nil {
+		d.intf.Close()
+		d.intf = nil
+	}
+
+	if d.cfg == nil {
+		cfgNum, err := d.ActiveConfigNum()
+		if err != nil {
+			return err
 		}
-	}()
 
-	return devices
+		d.cfg, err = d.Config(cfgNum)
+		if err != nil {
+			return err
+		}
+	}
+
+	d.intf, err = d.cfg.Interface(intfNum, altNum)
+
+	return err
+}
+
+func (d *dfulibusb) FunctionalDescriptor(cfgNum, intfNum int) ([]byte, error) {
+	//gousb does not keep class specific descriptors, read them from the device
+	raw, err := readConfigDescriptors(d.Control, len(d.Desc.Configs))
+	if err != nil {
+		return nil, err
+	}
+
+	return findFunctionalDescriptor(raw, cfgNum, intfNum)
+}
+
+func (d *dfulibusb) Reset() error {
+	err := d.Device.Reset()
+
+	//The device is gone when it re-enumerates with different descriptors
+	if err == gousb.ErrorNotFound {
+		return nil
+	}
+	return err
 }
 
 func (d *dfulibusb) Close() {
-	if d != nil {
-		d.Device.Close()
+	if d == nil {
+		return
+	}
+
+	if d.intf != nil {
+		d.intf.Close()
+	}
+
+	if d.cfg != nil {
+		d.cfg.Close()
 	}
 
+	d.Device.Close()
+
 	if d.ctx != nil {
 		d.ctx.Close()
 	}
@@ -52,6 +52,8 @@ func (d dfuSTDriver) Open(path string) (dfuDevice DFUDevice, err error) {
 
 			d = dfuSTDriver{&dev}
 			dfuDevice.dev = d
+			dfuDevice.cfgNum = dfuCONFIG
+			dfuDevice.intfNum = dfuINTERFACE
 			break
 		}
 	}
@@ -84,8 +86,8 @@ func (d dfuSTDriver) Control(rType, request uint8, val, idx uint16, data []byte)
 }
 
 func (d dfuSTDriver) InterfaceDescription(cfgNum, intfNum, altNum int) (string, error) {
-	//val, err := d.GetInterfaceDescriptor(uint(cfgNum), uint(intfNum), uint(altNum))
-	rawDesc, err := d.GetInterfaceDescriptor(uint(0), uint(0), uint(0))
+	//The ST driver indexes configurations from 0 rather than by bConfigurationValue
+	rawDesc, err := d.GetInterfaceDescriptor(uint(0), uint(intfNum), uint(altNum))
 
 	if err != nil {
 		return "", fmt.Errorf("Error getting interface descriptor: %v", err)
@@ -98,11 +100,40 @@ func (d dfuSTDriver) InterfaceDescription(cfgNum, intfNum, altNum int) (string,
 	return val, err
 }
 
+func (d dfuSTDriver) SetAltSetting(intfNum, altNum int) error {
+	return d.SelectCurrentConfiguration(0, uint(intfNum), uint(altNum))
+}
+
+func (d dfuSTDriver) FunctionalDescriptor(cfgNum, intfNum int) ([]byte, error) {
+	//The ST driver only binds to STM32 bootloaders and cannot read class
+	//specific descriptors
+	return defaultFunctionalDescriptor.bytes(), nil
+}
+
+func (d dfuSTDriver) OpenRuntime(path string) (DFUDevice, error) {
+	//The ST driver is only bound to devices in DFU mode
+	return DFUDevice{}, fmt.Errorf("Runtime mode devices are not supported by the ST driver")
+}
+
+func (d dfuSTDriver) ListRuntime(filter DeviceFilter) []string {
+	return nil
+}
+
+// Enumerate fails, the ST driver only sees devices in DFU mode so it cannot
+// tell when a device comes back as the application
+func (d dfuSTDriver) Enumerate(filter DeviceFilter) ([]DeviceInfo, error) {
+	return nil, fmt.Errorf("Enumerating devices outside of DFU mode is not supported by the ST driver")
+}
+
+func (d dfuSTDriver) Reset() error {
+	return fmt.Errorf("USB reset is not supported by the ST driver")
+}
+
 func (d dfuSTDriver) Close() {
 	d.STDevice.Close()
 }
 
-func (d dfuSTDriver) List() []string {
+func (d dfuSTDriver) List(filter DeviceFilter) []string {
 	devices := make([]string, 0)
 
 	//GUID of STM32F3 DFU Driver
@@ -119,6 +150,17 @@ func (d dfuSTDriver) List() []string {
 			break
 		}
 
+		//Device paths carry the ids, e.g. \\?\usb#vid_0483&pid_df11#...
+		var vid, pid uint16
+		lowerPath := strings.ToLower(devPath)
+		if idx := strings.Index(lowerPath, "vid_"); idx >= 0 {
+			fmt.Sscanf(lowerPath[idx:], "vid_%04x&pid_%04x", &vid, &pid)
+		}
+
+		if !filter.matches(vid, pid) {
+			continue
+		}
+
 		dev, err := sttub30.Open(devPath)
 		defer dev.Close()
 
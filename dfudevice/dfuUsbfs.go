@@ -0,0 +1,326 @@
+//go:build linux && !cgo
+// +build linux,!cgo
+
+package dfudevice
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// usbfs ioctl requests, see linux/usbdevice_fs.h
+const (
+	usbdevfsSetInterface     = 0x80085504 //_IOR('U', 4, struct usbdevfs_setinterface)
+	usbdevfsClaimInterface   = 0x8004550f //_IOR('U', 15, unsigned int)
+	usbdevfsReleaseInterface = 0x80045510 //_IOR('U', 16, unsigned int)
+	usbdevfsReset            = 0x00005514 //_IO('U', 20)
+
+	//_IOWR('U', 0, struct usbdevfs_ctrltransfer), the size depends on the pointer width
+	usbdevfsControl = 0xc0005500 | uintptr(unsafe.Sizeof(usbfsCtrlTransfer{}))<<16
+)
+
+const usbfsControlTimeout = 5000 //ms
+
+type usbfsCtrlTransfer struct {
+	bRequestType uint8
+	bRequest     uint8
+	wValue       uint16
+	wIndex       uint16
+	wLength      uint16
+	timeout      uint32
+	data         unsafe.Pointer
+}
+
+type usbfsSetInterface struct {
+	intf       uint32
+	altSetting uint32
+}
+
+// dfuUsbfs talks to devices through /dev/bus/usb without cgo or libusb
+type dfuUsbfs struct {
+	fd          int
+	claimedIntf int
+	descriptors []byte
+}
+
+func init() {
+	var d dfuUsbfs
+	addDriver(&d)
+}
+
+func usbfsIoctl(fd int, request uintptr, arg unsafe.Pointer) (int, error) {
+	r, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request, uintptr(arg))
+	if errno != 0 {
+		return int(r), errno
+	}
+	return int(r), nil
+}
+
+// List returns sysfs device names such as "1-2.3", the bus and port chain of
+// the device, which stay the same when the device re-enumerates
+func (d *dfuUsbfs) List(filter DeviceFilter) []string {
+	return usbfsList(filter, DeviceModeDFU)
+}
+
+func (d *dfuUsbfs) ListRuntime(filter DeviceFilter) []string {
+	return usbfsList(filter, DeviceModeRuntime)
+}
+
+func (d *dfuUsbfs) Enumerate(filter DeviceFilter) ([]DeviceInfo, error) {
+	return sysfsEnumerate(filter), nil
+}
+
+func usbfsList(filter DeviceFilter, mode DeviceMode) []string {
+	devices := make([]string, 0)
+
+	for _, info := range sysfsEnumerate(filter) {
+		if info.Mode == mode {
+			devices = append(devices, info.Path)
+		}
+	}
+
+	return devices
+}
+
+// usbfsNode returns the /dev/bus/usb node of the sysfs device name
+func usbfsNode(name string) (string, error) {
+	if strings.ContainsAny(name, "/:") || name == "" {
+		return "", fmt.Errorf("Not a usbfs device path: %q", name)
+	}
+
+	dir := filepath.Join(sysfsUSBDevices, name)
+	busNum, err := strconv.Atoi(readSysfs(dir, "busnum"))
+	if err != nil {
+		return "", fmt.Errorf("No USB device at %s", name)
+	}
+	devNum, err := strconv.Atoi(readSysfs(dir, "devnum"))
+	if err != nil {
+		return "", fmt.Errorf("No USB device at %s", name)
+	}
+
+	return fmt.Sprintf("/dev/bus/usb/%03d/%03d", busNum, devNum), nil
+}
+
+func (d dfuUsbfs) Open(path string) (DFUDevice, error) {
+	return usbfsOpen(path, usbProtocolDFU)
+}
+
+func (d dfuUsbfs) OpenRuntime(path string) (DFUDevice, error) {
+	return usbfsOpen(path, usbProtocolRuntime)
+}
+
+func usbfsOpen(path string, protocol uint8) (dfuDevice DFUDevice, err error) {
+	node, err := usbfsNode(path)
+	if err != nil {
+		return
+	}
+
+	fd, err := syscall.Open(node, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return dfuDevice, fmt.Errorf("Failed to open %s: %v", node, err)
+	}
+
+	device := &dfuUsbfs{fd: fd, claimedIntf: -1}
+
+	//Reading the node returns the device and every configuration descriptor
+	device.descriptors, err = usbfsReadAll(fd)
+	if err != nil {
+		device.Close()
+		return dfuDevice, fmt.Errorf("Failed to read descriptors of %s: %v", node, err)
+	}
+
+	interfaces, err := parseInterfaces(device.descriptors)
+	if err != nil {
+		device.Close()
+		return dfuDevice, err
+	}
+
+	activeCfg, _ := strconv.Atoi(readSysfs(filepath.Join(sysfsUSBDevices, path), "bConfigurationValue"))
+
+	found := false
+	for _, intf := range interfaces {
+		if intf.cfgValue == activeCfg && intf.class == usbClassApplication &&
+			intf.subClass == usbSubClassDFU && intf.protocol == protocol {
+			dfuDevice.cfgNum = intf.cfgValue
+			dfuDevice.intfNum = intf.number
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		device.Close()
+		return dfuDevice, fmt.Errorf("No DFU interface found on %s", path)
+	}
+
+	err = device.claim(dfuDevice.intfNum)
+	if err != nil {
+		device.Close()
+		return dfuDevice, err
+	}
+
+	dfuDevice.dev = device
+
+	//Runtime interfaces only have to support DETACH
+	if protocol == usbProtocolRuntime {
+		return
+	}
+
+	err = dfuDevice.ClearStatus()
+
+	if err != nil {
+		device.Close()
+		dfuDevice.dev = nil
+	}
+
+	return
+}
+
+func usbfsReadAll(fd int) ([]byte, error) {
+	data := make([]byte, 0, 512)
+	var buf [512]byte
+
+	for {
+		n, err := syscall.Read(fd, buf[:])
+		if err != nil {
+			return data, err
+		}
+		if n <= 0 {
+			return data, nil
+		}
+		data = append(data, buf[:n]...)
+	}
+}
+
+func (d *dfuUsbfs) claim(intfNum int) error {
+	if d.claimedIntf == intfNum {
+		return nil
+	}
+
+	if d.claimedIntf >= 0 {
+		intf := uint32(d.claimedIntf)
+		usbfsIoctl(d.fd, usbdevfsReleaseInterface, unsafe.Pointer(&intf))
+		d.claimedIntf = -1
+	}
+
+	intf := uint32(intfNum)
+	_, err := usbfsIoctl(d.fd, usbdevfsClaimInterface, unsafe.Pointer(&intf))
+	if err != nil {
+		return fmt.Errorf("Failed to claim interface %d: %v", intfNum, err)
+	}
+
+	d.claimedIntf = intfNum
+	return nil
+}
+
+func (d *dfuUsbfs) Control(rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	ctrl := usbfsCtrlTransfer{
+		bRequestType: rType,
+		bRequest:     request,
+		wValue:       val,
+		wIndex:       idx,
+		wLength:      uint16(len(data)),
+		timeout:      usbfsControlTimeout,
+	}
+
+	if len(data) > 0 {
+		ctrl.data = unsafe.Pointer(&data[0])
+	}
+
+	n, err := usbfsIoctl(d.fd, usbdevfsControl, unsafe.Pointer(&ctrl))
+	runtime.KeepAlive(data)
+
+	switch err {
+	case syscall.ENODEV, syscall.ESHUTDOWN:
+		return n, errNoDevice
+	case syscall.EPIPE:
+		return n, errPipe
+	}
+	return n, err
+}
+
+func (d *dfuUsbfs) SetAltSetting(intfNum, altNum int) error {
+	err := d.claim(intfNum)
+	if err != nil {
+		return err
+	}
+
+	setIntf := usbfsSetInterface{uint32(intfNum), uint32(altNum)}
+	_, err = usbfsIoctl(d.fd, usbdevfsSetInterface, unsafe.Pointer(&setIntf))
+
+	return err
+}
+
+func (d *dfuUsbfs) stringDescriptor(index uint8) (string, error) {
+	if index == 0 {
+		return "", nil
+	}
+
+	//Use the first language the device offers
+	var buf [255]byte
+	n, err := d.Control(0x80, usbRequestGetDescriptor, usbDescTypeString<<8, 0, buf[:])
+	if err != nil {
+		return "", fmt.Errorf("Failed to read string languages: %v", err)
+	}
+
+	langID := uint16(0x0409)
+	if n >= 4 {
+		langID = uint16(buf[2]) | uint16(buf[3])<<8
+	}
+
+	n, err = d.Control(0x80, usbRequestGetDescriptor, usbDescTypeString<<8|uint16(index), langID, buf[:])
+	if err != nil {
+		return "", fmt.Errorf("Failed to read string %d: %v", index, err)
+	}
+
+	return decodeStringDescriptor(buf[:n])
+}
+
+func (d *dfuUsbfs) InterfaceDescription(cfgNum, intfNum, altNum int) (string, error) {
+	interfaces, err := parseInterfaces(d.descriptors)
+	if err != nil {
+		return "", err
+	}
+
+	for _, intf := range interfaces {
+		if intf.cfgValue == cfgNum && intf.number == intfNum && intf.altSetting == altNum {
+			return d.stringDescriptor(intf.iInterface)
+		}
+	}
+
+	return "", fmt.Errorf("No interface %d alt setting %d in configuration %d", intfNum, altNum, cfgNum)
+}
+
+func (d *dfuUsbfs) FunctionalDescriptor(cfgNum, intfNum int) ([]byte, error) {
+	return findFunctionalDescriptor(d.descriptors, cfgNum, intfNum)
+}
+
+func (d *dfuUsbfs) Reset() error {
+	_, err := usbfsIoctl(d.fd, usbdevfsReset, nil)
+
+	//The device is gone when it re-enumerates with different descriptors
+	if err == syscall.ENODEV {
+		return nil
+	}
+	return err
+}
+
+func (d *dfuUsbfs) Close() {
+	if d == nil || d.fd < 0 {
+		return
+	}
+
+	if d.claimedIntf >= 0 {
+		intf := uint32(d.claimedIntf)
+		usbfsIoctl(d.fd, usbdevfsReleaseInterface, unsafe.Pointer(&intf))
+		d.claimedIntf = -1
+	}
+
+	syscall.Close(d.fd)
+	d.fd = -1
+}
@@ -0,0 +1,93 @@
+package dfudevice
+
+import (
+	"context"
+	"time"
+
+	"github.com/willtoth/go-dfuse/dfufile"
+)
+
+//Context variants of the long running operations. Once ctx is done the
+//operation stops before its next command and aborts the transfer in progress,
+//leaving the device in dfuIDLE. Every command is also bounded by the command
+//timeout of the device, see SetCommandTimeout.
+
+// WriteFileContext is WriteFile stopped when ctx is done
+func WriteFileContext(ctx context.Context, dfuFile dfufile.DFUFile, dfuDevice DFUDevice) error {
+	return WriteFile(dfuFile, dfuDevice.withContext(ctx))
+}
+
+// WriteFileWithOptionsContext is WriteFileWithOptions stopped when ctx is done
+func WriteFileWithOptionsContext(ctx context.Context, dfuFile dfufile.DFUFile, dfuDevice DFUDevice, options WriteOptions) ([]WriteResult, error) {
+	return WriteFileWithOptions(dfuFile, dfuDevice.withContext(ctx), options)
+}
+
+// VerifyFileContext is VerifyFile stopped when ctx is done
+func VerifyFileContext(ctx context.Context, dfuFile dfufile.DFUFile, dfuDevice DFUDevice) (bool, error) {
+	return VerifyFile(dfuFile, dfuDevice.withContext(ctx))
+}
+
+// WriteImageContext is WriteImage stopped when ctx is done
+func WriteImageContext(ctx context.Context, dfuImage dfufile.DFUImage, dfuDevice DFUDevice) error {
+	return WriteImage(dfuImage, dfuDevice.withContext(ctx))
+}
+
+// WriteImageWithOptionsContext is WriteImageWithOptions stopped when ctx is done
+func WriteImageWithOptionsContext(ctx context.Context, dfuImage dfufile.DFUImage, dfuDevice DFUDevice, options WriteOptions) (WriteResult, error) {
+	return WriteImageWithOptions(dfuImage, dfuDevice.withContext(ctx), options)
+}
+
+// VerifyImageContext is VerifyImage stopped when ctx is done
+func VerifyImageContext(ctx context.Context, dfuImage dfufile.DFUImage, dfuDevice DFUDevice) (bool, error) {
+	return VerifyImage(dfuImage, dfuDevice.withContext(ctx))
+}
+
+// ReadMemoryContext is ReadMemory stopped when ctx is done
+func (d DFUDevice) ReadMemoryContext(ctx context.Context, addr, length uint, progressMessage string) ([]byte, error) {
+	return d.withContext(ctx).ReadMemory(addr, length, progressMessage)
+}
+
+// WriteMemoryContext is WriteMemory stopped when ctx is done
+func (d DFUDevice) WriteMemoryContext(ctx context.Context, addr uint, data []byte, progressMessage string) error {
+	return d.withContext(ctx).WriteMemory(addr, data, progressMessage)
+}
+
+// MultiPageEraseContext is MultiPageErase stopped when ctx is done
+func (d DFUDevice) MultiPageEraseContext(ctx context.Context, addr, pagesToErase, pageSize uint, progressMessage string) error {
+	return d.withContext(ctx).MultiPageErase(addr, pagesToErase, pageSize, progressMessage)
+}
+
+// ErasePagesContext is ErasePages stopped when ctx is done
+func (d DFUDevice) ErasePagesContext(ctx context.Context, pages []uint, progressMessage string) error {
+	return d.withContext(ctx).ErasePages(pages, progressMessage)
+}
+
+// MassEraseContext is MassErase stopped when ctx is done
+func (d DFUDevice) MassEraseContext(ctx context.Context) error {
+	return d.withContext(ctx).MassErase()
+}
+
+// DownloadContext is Download stopped when ctx is done
+func (d DFUDevice) DownloadContext(ctx context.Context, data []byte, progressMessage string) error {
+	return d.withContext(ctx).Download(data, progressMessage)
+}
+
+// UploadContext is Upload stopped when ctx is done
+func (d DFUDevice) UploadContext(ctx context.Context, maxLength uint, progressMessage string) ([]byte, error) {
+	return d.withContext(ctx).Upload(maxLength, progressMessage)
+}
+
+// DetachToDFUContext is DetachToDFU stopped when ctx is done
+func DetachToDFUContext(ctx context.Context, path string, timeout time.Duration) (DFUDevice, error) {
+	return detachToDFU(ctx, path, timeout)
+}
+
+// WaitForDeviceContext is WaitForDevice stopped when ctx is done
+func WaitForDeviceContext(ctx context.Context, info DeviceInfo, timeout time.Duration) (DeviceInfo, error) {
+	return waitForDevice(ctx, info, timeout)
+}
+
+// ExitDFUAndWaitContext is ExitDFUAndWait stopped when ctx is done
+func (d DFUDevice) ExitDFUAndWaitContext(ctx context.Context, addr uint, timeout time.Duration) (DeviceInfo, error) {
+	return d.withContext(ctx).ExitDFUAndWait(addr, timeout)
+}
@@ -0,0 +1,131 @@
+package dfudevice
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandTimeoutBusy(t *testing.T) {
+	tests := []struct {
+		name           string
+		commandTimeout time.Duration
+		ctxTimeout     time.Duration
+		release        time.Duration
+		errText        string
+	}{
+		{name: "released within the command timeout", commandTimeout: 2 * time.Second, release: 200 * time.Millisecond},
+		{name: "command timeout", commandTimeout: 200 * time.Millisecond, errText: "deadline exceeded"},
+		{name: "context deadline", ctxTimeout: 200 * time.Millisecond, errText: "deadline exceeded"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sim := newTestSimulator(t, testFlash)
+			sim.PollTimeout = 1
+			sim.BusyPolls = 1 << 30
+
+			dev := sim.Device()
+			dev.SetCommandTimeout(test.commandTimeout)
+
+			ctx := context.Background()
+			if test.ctxTimeout != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, test.ctxTimeout)
+				defer cancel()
+			}
+
+			//Stuck in dfuDNBUSY until released
+			release := func() {
+				sim.mu.Lock()
+				sim.BusyPolls = 0
+				sim.busy = 0
+				sim.mu.Unlock()
+			}
+			if test.release != 0 {
+				timer := time.AfterFunc(test.release, release)
+				defer timer.Stop()
+			}
+
+			start := time.Now()
+			err := dev.MassEraseContext(ctx)
+			elapsed := time.Since(start)
+
+			if test.errText != "" {
+				if err == nil || !strings.Contains(err.Error(), test.errText) {
+					t.Fatalf("expected an error containing %q, got %v", test.errText, err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if elapsed < 150*time.Millisecond || elapsed > 2*time.Second {
+				t.Errorf("expected the erase to end after about 200ms, took %v", elapsed)
+			}
+
+			//Aborted back to dfuIDLE and usable once the device answers again
+			if state := sim.State(); test.errText != "" && state != dfuStateDfuIdle {
+				t.Errorf("expected dfuIDLE, got state %d", state)
+			}
+
+			release()
+			err = dev.MassErase()
+
+			if err != nil {
+				t.Errorf("MassErase() after the timeout failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestReadMemoryContextCancel(t *testing.T) {
+	const start, length = 0x08000000, 0x4000
+
+	sim := newTestSimulator(t, testFlash)
+	dev := sim.Device()
+
+	data := testPattern(length, 11)
+	err := sim.Load(0, start, data)
+
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+
+	//Cancelled while the third of eight blocks is read
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sim.Fault = func(op SimOperation, addr uint) SimFault {
+		if op == SimRead && addr == start+2*2048 {
+			cancel()
+		}
+		return SimFault{}
+	}
+
+	read, err := dev.ReadMemoryContext(ctx, start, length, "")
+
+	if err == nil || !strings.Contains(err.Error(), "Read stopped") {
+		t.Fatalf("expected the read to stop, got %v", err)
+	}
+
+	if sim.Stats.Reads != 3 {
+		t.Errorf("expected 3 blocks read, got %d", sim.Stats.Reads)
+	}
+
+	if len(read) < 3*2048 || !bytes.Equal(read[:3*2048], data[:3*2048]) {
+		t.Errorf("expected the blocks read before the cancel to match")
+	}
+
+	if state := sim.State(); state != dfuStateDfuIdle {
+		t.Errorf("expected dfuIDLE after the cancel, got state %d", state)
+	}
+
+	sim.Fault = nil
+	read, err = dev.ReadMemory(start, length, "")
+
+	if err != nil || !bytes.Equal(read, data) {
+		t.Errorf("ReadMemory() after the cancel returned %d bytes, %v", len(read), err)
+	}
+}
@@ -0,0 +1,260 @@
+package dfudevice
+
+import (
+	"fmt"
+	"unicode/utf16"
+)
+
+//USB descriptor types
+const (
+	usbDescTypeDevice    = 0x01
+	usbDescTypeConfig    = 0x02
+	usbDescTypeString    = 0x03
+	usbDescTypeInterface = 0x04
+)
+
+//DFU interface class codes
+const (
+	usbClassApplication = 0xfe
+	usbSubClassDFU      = 0x01
+	usbProtocolRuntime  = 0x01
+	usbProtocolDFU      = 0x02
+)
+
+//Standard requests
+const (
+	usbRequestGetDescriptor = 0x06
+)
+
+//DFU functional descriptor
+const (
+	dfuDescTypeFunctional = 0x21
+	dfuVersionDfuSe       = 0x011a
+
+	//bmAttributes bits
+	dfuAttrCanDnload             = 0x01
+	dfuAttrCanUpload             = 0x02
+	dfuAttrManifestationTolerant = 0x04
+	dfuAttrWillDetach            = 0x08
+)
+
+// FunctionalDescriptor is the DFU functional descriptor of the DFU interface,
+// it tells how the device expects to be driven
+type FunctionalDescriptor struct {
+	Attributes uint8
+	//DetachTimeout is the time in ms the device waits for a USB reset
+	//after DFU_DETACH before it gives up and stays in runtime mode
+	DetachTimeout uint16
+	//TransferSize is the largest block the device takes per DNLOAD or UPLOAD
+	TransferSize uint16
+	//DFUVersion is bcdDFUVersion, 0x011a for ST's DfuSe
+	DFUVersion uint16
+}
+
+// defaultFunctionalDescriptor matches the STM32 system bootloader, the ST
+// driver reports it as it cannot read class specific descriptors
+var defaultFunctionalDescriptor = FunctionalDescriptor{
+	Attributes:    dfuAttrCanDnload | dfuAttrCanUpload | dfuAttrWillDetach,
+	DetachTimeout: 255,
+	TransferSize:  2048,
+	DFUVersion:    dfuVersionDfuSe,
+}
+
+// CanDownload reports bitCanDnload, the device accepts DNLOAD
+func (f FunctionalDescriptor) CanDownload() bool {
+	return f.Attributes&dfuAttrCanDnload != 0
+}
+
+// CanUpload reports bitCanUpload, the device can be read back
+func (f FunctionalDescriptor) CanUpload() bool {
+	return f.Attributes&dfuAttrCanUpload != 0
+}
+
+// ManifestationTolerant reports bitManifestationTolerant, the device still
+// answers DFU requests after manifesting a download
+func (f FunctionalDescriptor) ManifestationTolerant() bool {
+	return f.Attributes&dfuAttrManifestationTolerant != 0
+}
+
+// WillDetach reports bitWillDetach, the device detaches and re-enumerates
+// on DFU_DETACH without waiting for a USB reset
+func (f FunctionalDescriptor) WillDetach() bool {
+	return f.Attributes&dfuAttrWillDetach != 0
+}
+
+// parseFunctionalDescriptor decodes a raw DFU functional descriptor
+func parseFunctionalDescriptor(raw []byte) (FunctionalDescriptor, error) {
+	var desc FunctionalDescriptor
+
+	//   B   bLength             9 (7 before DFU 1.1)
+	//   B   bDescriptorType     0x21
+	//   B   bmAttributes
+	//   H   wDetachTimeOut
+	//   H   wTransferSize
+	//   H   bcdDFUVersion
+	if len(raw) < 7 || raw[1] != dfuDescTypeFunctional {
+		return desc, fmt.Errorf("Invalid DFU functional descriptor % x", raw)
+	}
+
+	desc.Attributes = raw[2]
+	desc.DetachTimeout = uint16(raw[3]) | uint16(raw[4])<<8
+	desc.TransferSize = uint16(raw[5]) | uint16(raw[6])<<8
+	desc.DFUVersion = 0x0100
+
+	if len(raw) >= 9 {
+		desc.DFUVersion = uint16(raw[7]) | uint16(raw[8])<<8
+	}
+
+	if desc.TransferSize == 0 {
+		return desc, fmt.Errorf("DFU functional descriptor has no transfer size")
+	}
+
+	return desc, nil
+}
+
+// bytes encodes f as a raw DFU 1.1 functional descriptor
+func (f FunctionalDescriptor) bytes() []byte {
+	return []byte{
+		9, dfuDescTypeFunctional, f.Attributes,
+		byte(f.DetachTimeout), byte(f.DetachTimeout >> 8),
+		byte(f.TransferSize), byte(f.TransferSize >> 8),
+		byte(f.DFUVersion), byte(f.DFUVersion >> 8),
+	}
+}
+
+// usbInterfaceDesc is the part of an interface descriptor needed to find
+// and name DFU interfaces
+type usbInterfaceDesc struct {
+	cfgValue   int
+	number     int
+	altSetting int
+	class      uint8
+	subClass   uint8
+	protocol   uint8
+	iInterface uint8
+
+	//extra holds the class specific descriptors following the interface
+	//descriptor, for DFU this is the functional descriptor
+	extra []byte
+}
+
+// parseInterfaces walks raw configuration descriptors (as many as raw holds,
+// with or without a leading device descriptor) and returns every interface
+// and alternate setting found
+func parseInterfaces(raw []byte) ([]usbInterfaceDesc, error) {
+	interfaces := make([]usbInterfaceDesc, 0)
+	cfgValue := 0
+
+	for len(raw) >= 2 {
+		length := int(raw[0])
+		descType := raw[1]
+
+		if length < 2 || length > len(raw) {
+			return interfaces, fmt.Errorf("Malformed USB descriptor of type 0x%02x", descType)
+		}
+
+		desc := raw[:length]
+		raw = raw[length:]
+
+		switch descType {
+		case usbDescTypeConfig:
+			if length < 6 {
+				return interfaces, fmt.Errorf("Short USB configuration descriptor")
+			}
+			cfgValue = int(desc[5])
+		case usbDescTypeInterface:
+			if length < 9 {
+				return interfaces, fmt.Errorf("Short USB interface descriptor")
+			}
+			interfaces = append(interfaces, usbInterfaceDesc{
+				cfgValue:   cfgValue,
+				number:     int(desc[2]),
+				altSetting: int(desc[3]),
+				class:      desc[5],
+				subClass:   desc[6],
+				protocol:   desc[7],
+				iInterface: desc[8],
+			})
+		case usbDescTypeDevice:
+		default:
+			if last := len(interfaces) - 1; last >= 0 {
+				interfaces[last].extra = append(interfaces[last].extra, desc...)
+			}
+		}
+	}
+
+	return interfaces, nil
+}
+
+// decodeStringDescriptor converts a raw UTF-16LE string descriptor
+func decodeStringDescriptor(raw []byte) (string, error) {
+	if len(raw) < 2 || raw[1] != usbDescTypeString || int(raw[0]) > len(raw) {
+		return "", fmt.Errorf("Malformed USB string descriptor")
+	}
+
+	raw = raw[2:raw[0]]
+	chars := make([]uint16, len(raw)/2)
+	for idx := range chars {
+		chars[idx] = uint16(raw[2*idx]) | uint16(raw[2*idx+1])<<8
+	}
+
+	return string(utf16.Decode(chars)), nil
+}
+
+// findFunctionalDescriptor returns the DFU functional descriptor of the given
+// interface in raw configuration descriptors. It describes the interface as a
+// whole and may follow any of its alternate settings, the STM32 bootloader
+// puts it after the last one, so every alternate setting is searched like
+// dfu-util does.
+func findFunctionalDescriptor(raw []byte, cfgNum, intfNum int) ([]byte, error) {
+	interfaces, err := parseInterfaces(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	found := false
+	for _, intf := range interfaces {
+		if intf.cfgValue != cfgNum || intf.number != intfNum {
+			continue
+		}
+		found = true
+
+		//parseInterfaces already checked every descriptor length
+		for extra := intf.extra; len(extra) >= 2; extra = extra[extra[0]:] {
+			if extra[1] == dfuDescTypeFunctional {
+				return extra[:extra[0]], nil
+			}
+		}
+	}
+
+	if !found {
+		return nil, fmt.Errorf("No interface %d in configuration %d", intfNum, cfgNum)
+	}
+	return nil, fmt.Errorf("Interface %d has no DFU functional descriptor", intfNum)
+}
+
+// readConfigDescriptors fetches numConfigs complete configuration descriptors
+// with standard GET_DESCRIPTOR requests
+func readConfigDescriptors(control func(rType, request uint8, val, idx uint16, data []byte) (int, error), numConfigs int) ([]byte, error) {
+	raw := make([]byte, 0)
+
+	for cfgIdx := 0; cfgIdx < numConfigs; cfgIdx++ {
+		var header [9]byte
+		wValue := uint16(usbDescTypeConfig)<<8 | uint16(cfgIdx)
+
+		n, err := control(0x80, usbRequestGetDescriptor, wValue, 0, header[:])
+		if err != nil || n < 4 {
+			return raw, fmt.Errorf("Failed to read configuration descriptor %d: %v", cfgIdx, err)
+		}
+
+		full := make([]byte, int(header[2])|int(header[3])<<8)
+		n, err = control(0x80, usbRequestGetDescriptor, wValue, 0, full)
+		if err != nil {
+			return raw, fmt.Errorf("Failed to read configuration descriptor %d: %v", cfgIdx, err)
+		}
+
+		raw = append(raw, full[:n]...)
+	}
+
+	return raw, nil
+}
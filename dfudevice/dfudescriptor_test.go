@@ -0,0 +1,217 @@
+package dfudevice
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testConfigDesc(value uint8, body ...[]byte) []byte {
+	desc := []byte{9, usbDescTypeConfig, 0, 0, 1, value, 0, 0x80, 50}
+	for _, part := range body {
+		desc = append(desc, part...)
+	}
+
+	desc[2], desc[3] = byte(len(desc)), byte(len(desc)>>8)
+	return desc
+}
+
+func testInterfaceDesc(number, alt uint8) []byte {
+	return []byte{9, usbDescTypeInterface, number, alt, 0, usbClassApplication, usbSubClassDFU, usbProtocolDFU, 4 + alt}
+}
+
+//Functional descriptor of the STM32 system bootloader
+var testDfuSeDesc = FunctionalDescriptor{
+	Attributes:    dfuAttrCanDnload | dfuAttrCanUpload | dfuAttrWillDetach,
+	DetachTimeout: 255,
+	TransferSize:  2048,
+	DFUVersion:    dfuVersionDfuSe,
+}
+
+func TestParseFunctionalDescriptor(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      []byte
+		expected FunctionalDescriptor
+		errText  string
+	}{
+		{name: "DfuSe", raw: testDfuSeDesc.bytes(), expected: testDfuSeDesc},
+		{
+			name:     "DFU 1.1",
+			raw:      []byte{9, 0x21, 0x07, 0xe8, 0x03, 0x00, 0x04, 0x10, 0x01},
+			expected: FunctionalDescriptor{Attributes: 0x07, DetachTimeout: 1000, TransferSize: 1024, DFUVersion: 0x0110},
+		},
+		{
+			name:     "7 bytes before DFU 1.1",
+			raw:      []byte{7, 0x21, 0x03, 0x64, 0x00, 0x40, 0x00},
+			expected: FunctionalDescriptor{Attributes: 0x03, DetachTimeout: 100, TransferSize: 64, DFUVersion: 0x0100},
+		},
+		{name: "too short", raw: []byte{6, 0x21, 0x03, 0x64, 0x00, 0x40}, errText: "Invalid DFU functional descriptor"},
+		{name: "wrong type", raw: []byte{9, 0x24, 0x0b, 0xff, 0x00, 0x00, 0x08, 0x1a, 0x01}, errText: "Invalid DFU functional descriptor"},
+		{name: "no transfer size", raw: []byte{9, 0x21, 0x0b, 0xff, 0x00, 0x00, 0x00, 0x1a, 0x01}, errText: "no transfer size"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			desc, err := parseFunctionalDescriptor(test.raw)
+
+			if test.errText != "" {
+				if err == nil || !strings.Contains(err.Error(), test.errText) {
+					t.Fatalf("expected an error containing %q, got %v", test.errText, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if desc != test.expected {
+				t.Errorf("expected %+v, got %+v", test.expected, desc)
+			}
+		})
+	}
+}
+
+func TestParseInterfaces(t *testing.T) {
+	device := []byte{18, usbDescTypeDevice, 0x00, 0x02, 0, 0, 0, 64, 0x83, 0x04, 0x11, 0xdf, 0x00, 0x22, 1, 2, 3, 1}
+	functional := testDfuSeDesc.bytes()
+
+	tests := []struct {
+		name     string
+		raw      []byte
+		expected []usbInterfaceDesc
+		errText  string
+	}{
+		{
+			name: "alt settings with a trailing functional descriptor",
+			raw: append(device, testConfigDesc(1,
+				testInterfaceDesc(0, 0),
+				testInterfaceDesc(0, 1),
+				functional)...),
+			expected: []usbInterfaceDesc{
+				{cfgValue: 1, number: 0, altSetting: 0, class: usbClassApplication, subClass: usbSubClassDFU, protocol: usbProtocolDFU, iInterface: 4},
+				{cfgValue: 1, number: 0, altSetting: 1, class: usbClassApplication, subClass: usbSubClassDFU, protocol: usbProtocolDFU, iInterface: 5, extra: functional},
+			},
+		},
+		{
+			name: "two configurations",
+			raw:  append(testConfigDesc(1, testInterfaceDesc(0, 0)), testConfigDesc(2, testInterfaceDesc(1, 0))...),
+			expected: []usbInterfaceDesc{
+				{cfgValue: 1, number: 0, altSetting: 0, class: usbClassApplication, subClass: usbSubClassDFU, protocol: usbProtocolDFU, iInterface: 4},
+				{cfgValue: 2, number: 1, altSetting: 0, class: usbClassApplication, subClass: usbSubClassDFU, protocol: usbProtocolDFU, iInterface: 4},
+			},
+		},
+		{
+			name:    "length past the end",
+			raw:     testConfigDesc(1, []byte{9, usbDescTypeInterface, 0, 0}),
+			errText: "Malformed USB descriptor of type 0x04",
+		},
+		{
+			name:    "zero length",
+			raw:     testConfigDesc(1, []byte{0, usbDescTypeInterface}),
+			errText: "Malformed USB descriptor",
+		},
+		{
+			name:    "short interface",
+			raw:     testConfigDesc(1, []byte{4, usbDescTypeInterface, 0, 0}),
+			errText: "Short USB interface descriptor",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			interfaces, err := parseInterfaces(test.raw)
+
+			if test.errText != "" {
+				if err == nil || !strings.Contains(err.Error(), test.errText) {
+					t.Fatalf("expected an error containing %q, got %v", test.errText, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(interfaces, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, interfaces)
+			}
+		})
+	}
+}
+
+func TestFindFunctionalDescriptor(t *testing.T) {
+	functional := testDfuSeDesc.bytes()
+	vendor := []byte{4, 0x24, 0xaa, 0xbb}
+
+	tests := []struct {
+		name    string
+		raw     []byte
+		cfgNum  int
+		intfNum int
+		errText string
+	}{
+		{
+			name:   "after the only alt setting",
+			raw:    testConfigDesc(1, testInterfaceDesc(0, 0), functional),
+			cfgNum: 1,
+		},
+		{
+			name:   "after the last alt setting",
+			raw:    testConfigDesc(1, testInterfaceDesc(0, 0), testInterfaceDesc(0, 1), testInterfaceDesc(0, 2), functional),
+			cfgNum: 1,
+		},
+		{
+			name:   "after another class specific descriptor",
+			raw:    testConfigDesc(1, testInterfaceDesc(0, 0), vendor, functional),
+			cfgNum: 1,
+		},
+		{
+			name:    "second interface",
+			raw:     testConfigDesc(1, testInterfaceDesc(0, 0), vendor, testInterfaceDesc(1, 0), testInterfaceDesc(1, 1), functional),
+			cfgNum:  1,
+			intfNum: 1,
+		},
+		{
+			name:   "second configuration",
+			raw:    append(testConfigDesc(1, testInterfaceDesc(0, 0)), testConfigDesc(2, testInterfaceDesc(0, 0), functional)...),
+			cfgNum: 2,
+		},
+		{
+			name:    "belongs to another interface",
+			raw:     testConfigDesc(1, testInterfaceDesc(0, 0), testInterfaceDesc(1, 0), functional),
+			cfgNum:  1,
+			errText: "Interface 0 has no DFU functional descriptor",
+		},
+		{
+			name:    "no such interface",
+			raw:     testConfigDesc(1, testInterfaceDesc(0, 0), functional),
+			cfgNum:  1,
+			intfNum: 2,
+			errText: "No interface 2 in configuration 1",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raw, err := findFunctionalDescriptor(test.raw, test.cfgNum, test.intfNum)
+
+			if test.errText != "" {
+				if err == nil || !strings.Contains(err.Error(), test.errText) {
+					t.Fatalf("expected an error containing %q, got %v", test.errText, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !bytes.Equal(raw, functional) {
+				t.Errorf("expected % x, got % x", functional, raw)
+			}
+		})
+	}
+}
@@ -1,11 +1,9 @@
 package dfudevice
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
-	"regexp"
-	"strconv"
-	"strings"
 	"time"
 )
 
@@ -88,18 +86,78 @@ func (d dfuStatus) Wait() {
 	time.Sleep(time.Millisecond * time.Duration(d.bwPollTimeout))
 }
 
-const dfuINTERFACE = 0
+// waitContext is Wait, returning early when ctx is done
+func (d dfuStatus) waitContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(time.Millisecond * time.Duration(d.bwPollTimeout))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// DefaultCommandTimeout bounds a single DFU command, from waiting for the
+// device to be idle until it finished executing. Mass erasing large parts
+// takes tens of seconds.
+const DefaultCommandTimeout = 30 * time.Second
+
+//Default configuration value and interface number of the DFU interface,
+//drivers that can discover them set cfgNum and intfNum on the DFUDevice
+const (
+	dfuCONFIG    = 1
+	dfuINTERFACE = 0
+)
+
+// DeviceFilter restricts the devices returned by ListFiltered, zero values
+// match any device
+type DeviceFilter struct {
+	VID uint16
+	PID uint16
+}
+
+func (f DeviceFilter) matches(vid, pid uint16) bool {
+	return (f.VID == 0 || f.VID == vid) && (f.PID == 0 || f.PID == pid)
+}
 
 func List() []string {
+	return ListFiltered(DeviceFilter{})
+}
+
+// ListFiltered returns the paths of the DFU devices matching filter, each
+// path can be passed to Open
+func ListFiltered(filter DeviceFilter) []string {
 	result := make([]string, 0)
 	for _, driver := range dfuDriverList {
-		result = append(result, driver.List()...)
+		result = append(result, driver.List(filter)...)
 	}
 	return result
 }
 
 type DFUDevice struct {
-	dev dfuDriver
+	dev  dfuDriver
+	path string
+
+	cfgNum     int
+	intfNum    int
+	altSetting int
+
+	//alternate setting the interface is really on, shared by every copy of
+	//the device as SelectAltSetting on a copy switches it for all of them
+	interfaceAlt *int
+
+	//functional descriptor of the DFU interface, read by Open
+	functional FunctionalDescriptor
+
+	//ctx stops every operation once done, set by the Context variants
+	ctx            context.Context
+	commandTimeout time.Duration
 
 	progressBars progressList
 }
@@ -108,6 +166,53 @@ func (d *DFUDevice) RegisterProgress(progress Progress) {
 	d.progressBars.add(progress)
 }
 
+// SetCommandTimeout sets how long a single DFU command may take before it
+// fails, 0 restores DefaultCommandTimeout
+func (d *DFUDevice) SetCommandTimeout(timeout time.Duration) {
+	d.commandTimeout = timeout
+}
+
+// withContext returns a copy of d whose operations stop once ctx is done
+func (d DFUDevice) withContext(ctx context.Context) DFUDevice {
+	d.ctx = ctx
+	return d
+}
+
+func (d DFUDevice) context() context.Context {
+	if d.ctx == nil {
+		return context.Background()
+	}
+	return d.ctx
+}
+
+// commandContext bounds a single command by the command timeout
+func (d DFUDevice) commandContext() (context.Context, context.CancelFunc) {
+	timeout := d.commandTimeout
+	if timeout == 0 {
+		timeout = DefaultCommandTimeout
+	}
+	return context.WithTimeout(d.context(), timeout)
+}
+
+// checkContext returns the error of a cancelled operation, after aborting
+// the transfer the device is in so it is left in dfuIDLE
+func (d DFUDevice) checkContext() error {
+	err := d.context().Err()
+
+	if err != nil {
+		d.Abort()
+	}
+	return err
+}
+
+// abortOnTimeout aborts the command in progress when ctx, the context of a
+// single command, is done rather than the device failing to answer
+func (d DFUDevice) abortOnTimeout(ctx context.Context) {
+	if ctx.Err() != nil {
+		d.Abort()
+	}
+}
+
 func (d DFUDevice) Close() {
 	if d.dev != nil {
 		d.dev.Close()
@@ -119,23 +224,142 @@ func Open(path string) (device DFUDevice, err error) {
 	for _, driver := range dfuDriverList {
 		device, err = driver.Open(path)
 		if err == nil {
+			device.path = path
+			device.trackAltSetting()
+			err = device.loadFunctionalDescriptor()
+
+			if err != nil {
+				device.Close()
+				return DFUDevice{}, err
+			}
 			break
 		}
 	}
 	return
 }
 
+// trackAltSetting starts tracking the alternate setting of a newly opened
+// device, copies made afterwards share it
+func (d *DFUDevice) trackAltSetting() {
+	alt := d.altSetting
+	d.interfaceAlt = &alt
+}
+
+// loadFunctionalDescriptor reads the DFU functional descriptor, it picks the
+// protocol and the transfer size. A device without a valid one is refused
+// rather than guessing which protocol it speaks.
+func (d *DFUDevice) loadFunctionalDescriptor() error {
+	raw, err := d.dev.FunctionalDescriptor(d.cfgNum, d.intfNum)
+
+	if err != nil {
+		return fmt.Errorf("Failed to read the DFU functional descriptor: %v", err)
+	}
+
+	desc, err := parseFunctionalDescriptor(raw)
+
+	if err != nil {
+		return err
+	}
+
+	d.functional = desc
+	return nil
+}
+
+// FunctionalDescriptor returns the DFU functional descriptor read when the
+// device was opened
+func (d DFUDevice) FunctionalDescriptor() FunctionalDescriptor {
+	return d.functional
+}
+
+// IsDfuSe reports whether the device speaks ST's DfuSe extensions (addressed
+// transfers, erase and set-address commands) rather than plain DFU 1.1
+func (d DFUDevice) IsDfuSe() bool {
+	return d.functional.DFUVersion == dfuVersionDfuSe
+}
+
+// DFUVersion returns bcdDFUVersion of the device, 0x011a for DfuSe
+func (d DFUDevice) DFUVersion() uint16 {
+	return d.functional.DFUVersion
+}
+
+// transferSize is the block size of every DNLOAD and UPLOAD, DfuSe devices
+// also use it to compute block addresses
+func (d DFUDevice) transferSize() int {
+	if d.functional.TransferSize == 0 {
+		return int(defaultFunctionalDescriptor.TransferSize)
+	}
+	return int(d.functional.TransferSize)
+}
+
+// SelectAltSetting switches the DFU interface to the given alternate setting,
+// each alternate setting addresses a different memory (flash, option bytes...)
+func (d *DFUDevice) SelectAltSetting(alt int) error {
+	if d.dev == nil {
+		return fmt.Errorf("SelectAltSetting(): Device not initialized")
+	}
+
+	err := d.dev.SetAltSetting(d.intfNum, alt)
+
+	if err != nil {
+		return fmt.Errorf("Failed to select alternate setting %d: %v", alt, err)
+	}
+
+	d.altSetting = alt
+	if d.interfaceAlt != nil {
+		*d.interfaceAlt = alt
+	}
+	return nil
+}
+
+// restoreAltSetting selects the alternate setting of d again when a copy of
+// d has switched the interface to another one since
+func (d DFUDevice) restoreAltSetting() error {
+	if d.interfaceAlt == nil || *d.interfaceAlt == d.altSetting {
+		return nil
+	}
+
+	err := d.dev.SetAltSetting(d.intfNum, d.altSetting)
+
+	if err != nil {
+		return fmt.Errorf("Failed to select alternate setting %d again: %v", d.altSetting, err)
+	}
+
+	*d.interfaceAlt = d.altSetting
+	return nil
+}
+
+// AltSetting returns the currently selected alternate setting
+func (d DFUDevice) AltSetting() int {
+	return d.altSetting
+}
+
 func (d DFUDevice) ClearStatus() error {
 	if d.dev == nil {
 		return fmt.Errorf("ClearStatus(): Device not initialized")
 	}
 
-	_, err := d.dev.Control(0x21, cmdCLRSTATUS, 0, dfuINTERFACE, nil)
+	_, err := d.dev.Control(0x21, cmdCLRSTATUS, 0, uint16(d.intfNum), nil)
 
 	return err
 }
 
-func (d DFUDevice) GetStatus() (status dfuStatus, err error) {
+// Abort ends an upload or download early, returning the device to dfuIDLE
+func (d DFUDevice) Abort() error {
+	if d.dev == nil {
+		return fmt.Errorf("Abort(): Device not initialized")
+	}
+
+	_, err := d.dev.Control(0x21, cmdABORT, 0, uint16(d.intfNum), nil)
+
+	return err
+}
+
+func (d DFUDevice) GetStatus() (dfuStatus, error) {
+	return d.getStatus(d.context())
+}
+
+// getStatus is GetStatus, giving up on the bwPollTimeout wait once ctx is done
+func (d DFUDevice) getStatus(ctx context.Context) (status dfuStatus, err error) {
 	status.bStatus = dfuStatusErrorUnknown
 	status.bState = dfuStateDfuError
 	if d.dev == nil {
@@ -145,10 +369,10 @@ func (d DFUDevice) GetStatus() (status dfuStatus, err error) {
 
 	var rawbuf [6]byte
 
-	_, err = d.dev.Control(0xA1, cmdGETSTATUS, 0, dfuINTERFACE, rawbuf[:])
+	_, err = d.dev.Control(0xA1, cmdGETSTATUS, 0, uint16(d.intfNum), rawbuf[:])
 
 	if err != nil {
-		err = fmt.Errorf("Control transfer in GetStatus() failed: %v", err)
+		err = fmt.Errorf("Control transfer in GetStatus() failed: %w", err)
 		return
 	}
 
@@ -158,14 +382,14 @@ func (d DFUDevice) GetStatus() (status dfuStatus, err error) {
 	status.iString = rawbuf[5]
 
 	//Wait the bwPollTimeout() time TODO: Should this be here or up to the implementation?
-	status.Wait()
+	err = status.waitContext(ctx)
 
 	return
 }
 
 const (
 	dnloadCmdErase         = 0x41
-	dnloadCmdReadUnprotect = 0x92 //not implemented
+	dnloadCmdReadUnprotect = 0x92
 	dnloadCmdSetAddress    = 0x21
 )
 
@@ -179,27 +403,41 @@ func (d DFUDevice) dnloadSpecialCommand(command byte, buffer []byte) error {
 }
 
 func (d DFUDevice) dnloadWaitOnIdle() error {
-	var status dfuStatus
-	var err error
+	return d.waitOnIdle(dfuStateDfuDownloadIdle)
+}
+
+// waitOnIdle polls the device until it is in dfuIDLE or idleState, clearing
+// errors and aborting other transfers, for at most the command timeout
+func (d DFUDevice) waitOnIdle(idleState uint8) error {
+	err := d.restoreAltSetting()
+
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := d.commandContext()
+	defer cancel()
 
-	//TODO: Implement timeouts
-	for true {
-		//Check that the device is in the IDLE or DNLOAD-IDLE states before proceeding
-		status, err = d.GetStatus()
+	for {
+		//Check that the device is in the IDLE or given IDLE state before proceeding
+		status, err := d.getStatus(ctx)
 
 		if err != nil {
-			return fmt.Errorf("Initial GetStatus() failed in dnload command: %v: ", err)
+			if ctx.Err() != nil {
+				return fmt.Errorf("Device did not become idle, state: %d: %v", status.bState, err)
+			}
+			return fmt.Errorf("Initial GetStatus() failed: %v", err)
 		}
 
-		if status.bState != dfuStateDfuIdle && status.bState != dfuStateDfuDownloadIdle {
-			//fmt.Printf("State is not set for dnload, found to be: %d, string %s\r\nAttempting to clear status...\r\n", status.bState, status)
+		switch status.bState {
+		case dfuStateDfuIdle, idleState:
+			return nil
+		case dfuStateDfuError:
 			d.ClearStatus()
-		} else {
-			break
+		case dfuStateDfuDownloadIdle, dfuStateDfuUploadIdle:
+			d.Abort()
 		}
 	}
-
-	return err
 }
 
 //dnload requests implemented per STM32 app note AN3156
@@ -217,16 +455,20 @@ func (d DFUDevice) dnloadCommand(wValue uint16, buffer []byte) error {
 		return err
 	}
 
-	_, err = d.dev.Control(0x21, cmdDNLOAD, wValue, dfuINTERFACE, buffer)
+	ctx, cancel := d.commandContext()
+	defer cancel()
+
+	_, err = d.dev.Control(0x21, cmdDNLOAD, wValue, uint16(d.intfNum), buffer)
 
 	if err != nil {
 		return fmt.Errorf("Control Transfer failed after initial dnload command: %v: ", err)
 	}
 
-	status, err = d.GetStatus()
+	status, err = d.getStatus(ctx)
 
 	if err != nil {
-		return fmt.Errorf("Failed to get status after dnload command: %d, %v", err)
+		d.abortOnTimeout(ctx)
+		return fmt.Errorf("Failed to get status after dnload command: %v", err)
 	}
 
 	//First status should always return dfuStateDfuDownloadBusy, this starts the operation
@@ -234,12 +476,13 @@ func (d DFUDevice) dnloadCommand(wValue uint16, buffer []byte) error {
 		return fmt.Errorf("Wrong state after dnload command expected dfuStateDfuDownloadBusy")
 	}
 
-	//TODO: Add additional condition for timeout
+	//Bounded by the command timeout, a hung device stays busy forever
 	for status.bState == dfuStateDfuDownloadBusy {
 
-		status, err = d.GetStatus()
+		status, err = d.getStatus(ctx)
 
 		if err != nil {
+			d.abortOnTimeout(ctx)
 			return fmt.Errorf("Failed while polling status during dnload command: %v", err)
 		}
 
@@ -264,13 +507,65 @@ func (d DFUDevice) dnloadCommand(wValue uint16, buffer []byte) error {
 }
 
 func (d DFUDevice) MultiPageErase(addr, pagesToErase, pageSize uint, progressMessage string) error {
+	err := d.checkAccess(addr, pagesToErase*pageSize, memErasable)
+
+	if err != nil {
+		return fmt.Errorf("Page Erase Error address 0x%x: %v", addr, err)
+	}
+
 	d.progressBars.setStatus(progressMessage)
 	d.progressBars.setMax(pagesToErase)
 	d.progressBars.setIncrement(1)
 	d.progressBars.reset()
 
 	for numPages := uint(0); numPages < pagesToErase; numPages++ {
-		err := d.PageErase(addr + ((numPages) * pageSize))
+		err := d.checkContext()
+
+		if err != nil {
+			return fmt.Errorf("Page Erase stopped at address 0x%x: %v", addr+numPages*pageSize, err)
+		}
+
+		err = d.pageErase(addr + ((numPages) * pageSize))
+
+		if err != nil {
+			return err
+		}
+
+		d.progressBars.increment()
+	}
+	return nil
+}
+
+// ErasePages erases each page (sector) starting at the given addresses, the
+// pages may be of different sizes
+func (d DFUDevice) ErasePages(pages []uint, progressMessage string) error {
+	region, err := d.GetMemoryRegion(d.altSetting)
+
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range pages {
+		err = region.checkAccess(addr, 0, memErasable)
+
+		if err != nil {
+			return fmt.Errorf("Page Erase Error address 0x%x: %v", addr, err)
+		}
+	}
+
+	d.progressBars.setStatus(progressMessage)
+	d.progressBars.setMax(uint(len(pages)))
+	d.progressBars.setIncrement(1)
+	d.progressBars.reset()
+
+	for _, addr := range pages {
+		err = d.checkContext()
+
+		if err != nil {
+			return fmt.Errorf("Page Erase stopped at address 0x%x: %v", addr, err)
+		}
+
+		err = d.pageErase(addr)
 
 		if err != nil {
 			return err
@@ -282,6 +577,16 @@ func (d DFUDevice) MultiPageErase(addr, pagesToErase, pageSize uint, progressMes
 }
 
 func (d DFUDevice) PageErase(addr uint) error {
+	err := d.checkAccess(addr, 0, memErasable)
+
+	if err != nil {
+		return fmt.Errorf("Page Erase Error address 0x%x: %v", addr, err)
+	}
+
+	return d.pageErase(addr)
+}
+
+func (d DFUDevice) pageErase(addr uint) error {
 	cmdBuffer := make([]byte, 4)
 
 	binary.LittleEndian.PutUint32(cmdBuffer[:], uint32(addr))
@@ -303,6 +608,39 @@ func (d DFUDevice) MassErase() error {
 	return nil
 }
 
+// ReadUnprotect removes read protection. The device mass erases its memory
+// and resets, so it has to be opened again afterwards.
+func (d DFUDevice) ReadUnprotect() error {
+	if d.dev == nil {
+		return fmt.Errorf("ReadUnprotect(): Device not initialized")
+	}
+
+	err := d.dnloadWaitOnIdle()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = d.dev.Control(0x21, cmdDNLOAD, 0, uint16(d.intfNum), []byte{dnloadCmdReadUnprotect})
+
+	if err != nil {
+		return fmt.Errorf("Control Transfer failed in read unprotect: %v", err)
+	}
+
+	//The first status starts the operation, the device resets once it is done
+	status, err := d.GetStatus()
+
+	if err != nil {
+		return fmt.Errorf("Failed to get status after read unprotect: %v", err)
+	}
+
+	if status.bState != dfuStateDfuDownloadBusy {
+		return fmt.Errorf("Wrong state after read unprotect, expected dfuStateDfuDownloadBusy, code string: %s", status)
+	}
+
+	return nil
+}
+
 func (d DFUDevice) SetAddress(addr uint) error {
 	cmdBuffer := make([]byte, 4)
 	binary.LittleEndian.PutUint32(cmdBuffer[:], uint32(addr))
@@ -321,8 +659,8 @@ func (d DFUDevice) WriteMemory(addr uint, data []byte, progressMessage string) e
 		return fmt.Errorf("Error in SetAddress of Write Memory: %v", err)
 	}
 
-	//block size, write in max block size (2048 bytes)
-	transferSize := 2048
+	//block size, write in blocks of wTransferSize
+	transferSize := d.transferSize()
 	bytesLeftToTransfer := len(data)
 
 	d.progressBars.setStatus(progressMessage)
@@ -340,6 +678,12 @@ func (d DFUDevice) WriteMemory(addr uint, data []byte, progressMessage string) e
 
 	//address = ((wValue - 2) * transferSize) + addr
 	for bytesLeftToTransfer > 0 {
+		err = d.checkContext()
+
+		if err != nil {
+			return fmt.Errorf("Write stopped at address 0x%x: %v", int(blockNum)*transferSize+int(addr), err)
+		}
+
 		//thisAddr := int(blockNum)*transferSize + int(addr)
 		//final transfer is less than transfer size, must reset address
 		if bytesLeftToTransfer < transferSize {
@@ -383,6 +727,10 @@ func (d DFUDevice) WriteMemory(addr uint, data []byte, progressMessage string) e
 //}
 
 func (d DFUDevice) ExitDFU(addr uint) error {
+	if !d.IsDfuSe() {
+		return d.exitPlain()
+	}
+
 	err := d.SetAddress(addr)
 
 	if err != nil {
@@ -392,7 +740,7 @@ func (d DFUDevice) ExitDFU(addr uint) error {
 	d.dnloadWaitOnIdle()
 
 	//Transfer next block
-	_, err = d.dev.Control(0x21, cmdDNLOAD, 0, dfuINTERFACE, nil)
+	_, err = d.dev.Control(0x21, cmdDNLOAD, 0, uint16(d.intfNum), nil)
 
 	status, err := d.GetStatus()
 
@@ -404,27 +752,7 @@ func (d DFUDevice) ExitDFU(addr uint) error {
 }
 
 func (d DFUDevice) uploadWaitOnIdle() error {
-	var status dfuStatus
-	var err error
-
-	//TODO: Implement timeouts
-	for true {
-		//Check that the device is in the IDLE or DNLOAD-IDLE states before proceeding
-		status, err = d.GetStatus()
-
-		if err != nil {
-			return fmt.Errorf("Initial GetStatus() failed in dnload command: %v: ", err)
-		}
-
-		if status.bState != dfuStateDfuIdle && status.bState != dfuStateDfuUploadIdle {
-			//fmt.Printf("State is not set for upload, found to be: %d, string: %s\r\nAttempting to clear status...\r\n", status.bState, status)
-			d.ClearStatus()
-		} else {
-			break
-		}
-	}
-
-	return err
+	return d.waitOnIdle(dfuStateDfuUploadIdle)
 }
 
 func (d DFUDevice) ReadMemory(addr, length uint, progressMessage string) ([]byte, error) {
@@ -434,14 +762,24 @@ func (d DFUDevice) ReadMemory(addr, length uint, progressMessage string) ([]byte
 		return data, nil
 	}
 
-	err := d.SetAddress(addr)
+	if !d.functional.CanUpload() {
+		return data, fmt.Errorf("Error in Read Memory: device does not support upload")
+	}
+
+	err := d.checkAccess(addr, length, memReadable)
 
 	if err != nil {
 		return data, fmt.Errorf("Error in Read Memory: %v", err)
 	}
 
-	//block size, write in max block size (2048 bytes)
-	transferSize := 2048
+	err = d.SetAddress(addr)
+
+	if err != nil {
+		return data, fmt.Errorf("Error in Read Memory: %v", err)
+	}
+
+	//block size, read in blocks of wTransferSize
+	transferSize := d.transferSize()
 	blockNum := uint16(0)
 	bytesLeftToTransfer := int(length)
 
@@ -459,7 +797,7 @@ func (d DFUDevice) ReadMemory(addr, length uint, progressMessage string) ([]byte
 			return data, err
 		}
 
-		_, err = d.dev.Control(0xA1, cmdUPLOAD, blockNum+2, dfuINTERFACE, data)
+		_, err = d.dev.Control(0xA1, cmdUPLOAD, blockNum+2, uint16(d.intfNum), data)
 
 		d.progressBars.increment()
 
@@ -470,6 +808,11 @@ func (d DFUDevice) ReadMemory(addr, length uint, progressMessage string) ([]byte
 
 	//address = ((wValue - 2) * transferSize) + addr
 	for bytesLeftToTransfer > 0 {
+		err = d.checkContext()
+
+		if err != nil {
+			return data, fmt.Errorf("Read stopped at address 0x%x: %v", int(blockNum)*transferSize+int(addr), err)
+		}
 
 		err = d.uploadWaitOnIdle()
 
@@ -497,7 +840,7 @@ func (d DFUDevice) ReadMemory(addr, length uint, progressMessage string) ([]byte
 			}
 
 			//fmt.Printf("Reading from 0x%x, bytes left : %d\r\n", thisAddr, 0)
-			_, err = d.dev.Control(0xA1, cmdUPLOAD, blockNum+2, dfuINTERFACE, dataSlice)
+			_, err = d.dev.Control(0xA1, cmdUPLOAD, blockNum+2, uint16(d.intfNum), dataSlice)
 
 			if err != nil {
 				return nil, fmt.Errorf("Read failed after final upload address 0x%x: %v", int(blockNum)*transferSize+int(addr), err)
@@ -513,7 +856,7 @@ func (d DFUDevice) ReadMemory(addr, length uint, progressMessage string) ([]byte
 		//fmt.Printf("Reading from 0x%x, bytes left : %d\r\n", thisAddr, bytesLeftToTransfer)
 
 		//Transfer next block
-		_, err = d.dev.Control(0xA1, cmdUPLOAD, blockNum+2, dfuINTERFACE, dataSlice)
+		_, err = d.dev.Control(0xA1, cmdUPLOAD, blockNum+2, uint16(d.intfNum), dataSlice)
 
 		d.progressBars.increment()
 
@@ -529,60 +872,3 @@ func (d DFUDevice) ReadMemory(addr, length uint, progressMessage string) ([]byte
 func computeCRC() {
 
 }
-
-type MemoryLayout struct {
-	StartAddress uint
-	Pages        uint
-	PageSize     uint
-	Size         uint
-}
-
-func (d DFUDevice) GetMemoryLayout() (mem []MemoryLayout, err error) {
-	//intf, done, _ := d.getInterface()
-	//defer done()
-
-	//TODO: Get the proper config and interface id
-	desc, err := d.dev.InterfaceDescription(1, 0, 0)
-
-	descValues := strings.Split(desc, "/")
-
-	addr, err := strconv.ParseUint(descValues[1], 0, 32)
-	segments := strings.Split(descValues[2], ",")
-
-	segmentRegex := regexp.MustCompile(`(\d+)\*(\d+)(.)(.)`)
-
-	mem = make([]MemoryLayout, len(segments))
-
-	for idx, segment := range segments {
-		segMatches := segmentRegex.FindAllStringSubmatch(segment, 3)
-
-		if segMatches == nil || len(segMatches[0]) < 3 {
-			err = fmt.Errorf("Bad descriptor returned from usb device, unable to parse memory map")
-			return mem, err
-		}
-
-		numPages, err := strconv.ParseUint(segMatches[0][1], 0, 32)
-		if err != nil {
-			continue
-		}
-		pageSize, err := strconv.ParseUint(segMatches[0][2], 0, 32)
-		if err != nil {
-			continue
-		}
-		multiplier := segMatches[0][3]
-
-		if multiplier[0] == 'K' {
-			pageSize *= 1024
-		} else if multiplier[0] == 'M' {
-			pageSize *= 1024 * 1024
-		}
-
-		mem[idx].StartAddress = uint(addr)
-		mem[idx].Pages = uint(numPages)
-		mem[idx].PageSize = uint(pageSize)
-		mem[idx].Size = mem[idx].Pages * mem[idx].PageSize
-
-		addr += uint64(mem[idx].Size)
-	}
-	return
-}
@@ -0,0 +1,168 @@
+package dfudevice
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/willtoth/go-dfuse/dfufile"
+)
+
+// pageSpan is the part of a page (sector) covered by a target
+type pageSpan struct {
+	target int
+	page   uint
+	addr   uint
+	data   []byte
+}
+
+// targetSpans splits target at the page boundaries of region
+func targetSpans(region MemoryRegion, targetIdx int, target dfufile.DFUTarget) ([]pageSpan, error) {
+	spans := make([]pageSpan, 0)
+	addr := uint(target.Prefix.Address)
+	data := target.Elements
+
+	for len(data) > 0 {
+		segment, found := region.Find(addr)
+
+		if !found {
+			return nil, fmt.Errorf("Address 0x%x is outside of the memory map of %s", addr, region.Name)
+		}
+
+		page := segment.StartAddress + (addr-segment.StartAddress)/segment.PageSize*segment.PageSize
+		count := page + segment.PageSize - addr
+		if count > uint(len(data)) {
+			count = uint(len(data))
+		}
+
+		spans = append(spans, pageSpan{targetIdx, page, addr, data[:count]})
+
+		addr += count
+		data = data[count:]
+	}
+
+	return spans, nil
+}
+
+// writeDifferential compares every page covered by dfuImage with the device
+// and only erases (per options.Erase) and writes the pages that differ,
+// recording written and skipped bytes in result
+func writeDifferential(dfuImage dfufile.DFUImage, dfuDevice DFUDevice, region MemoryRegion, options WriteOptions, result *WriteResult) error {
+	if options.Erase == EraseModeMass {
+		return fmt.Errorf("Differential write cannot be combined with a mass erase")
+	}
+
+	spans := make([]pageSpan, 0)
+
+	for idx, target := range dfuImage.Targets {
+		targetSpans, err := targetSpans(region, idx, target)
+
+		if err != nil {
+			return err
+		}
+
+		spans = append(spans, targetSpans...)
+	}
+
+	//A page is dirty as soon as one of its spans differs, unreadable pages
+	//cannot be compared and are always rewritten
+	dirty := make(map[uint]bool)
+
+	for _, span := range spans {
+		if dirty[span.page] {
+			continue
+		}
+
+		segment, _ := region.Find(span.page)
+
+		if !segment.Readable {
+			dirty[span.page] = true
+			continue
+		}
+
+		deviceData, err := dfuDevice.ReadMemory(span.addr, uint(len(span.data)), "Comparing Pages")
+
+		if err != nil {
+			return fmt.Errorf("Differential write failed to read device memory: %v", err)
+		}
+
+		if bytes.Equal(deviceData, span.data) == false {
+			dirty[span.page] = true
+		}
+	}
+
+	for _, span := range spans {
+		if !dirty[span.page] {
+			result.Targets[span.target].BytesSkipped += uint(len(span.data))
+		}
+	}
+
+	if len(dirty) == 0 {
+		return nil
+	}
+
+	if options.Erase == EraseModePages {
+		pages, err := planErase(region, dfuImage.Targets)
+
+		if err != nil {
+			return err
+		}
+
+		dirtyPages := make([]uint, 0, len(dirty))
+		for _, page := range pages {
+			if dirty[page] {
+				dirtyPages = append(dirtyPages, page)
+			}
+		}
+
+		err = dfuDevice.ErasePages(dirtyPages, "Erasing Pages")
+
+		if err != nil {
+			return err
+		}
+	}
+
+	//Write runs of consecutive dirty spans with as few transfers as possible
+	var runAddr uint
+	var run []byte
+	var runSpans []pageSpan
+
+	flush := func() error {
+		if len(run) == 0 {
+			return nil
+		}
+
+		err := dfuDevice.WriteMemory(runAddr, run, "Writing Image")
+		written := runSpans
+		run, runSpans = nil, nil
+
+		if err != nil {
+			result.Targets[written[0].target].Err = err
+			return fmt.Errorf("Failed to write target %d at 0x%x: %v", written[0].target, runAddr, err)
+		}
+
+		for _, span := range written {
+			result.Targets[span.target].BytesWritten += uint(len(span.data))
+		}
+		return nil
+	}
+
+	for _, span := range spans {
+		if !dirty[span.page] || (len(run) > 0 && runAddr+uint(len(run)) != span.addr) {
+			err := flush()
+
+			if err != nil {
+				return err
+			}
+		}
+
+		if dirty[span.page] {
+			if len(run) == 0 {
+				runAddr = span.addr
+			}
+			run = append(run, span.data...)
+			runSpans = append(runSpans, span)
+		}
+	}
+
+	return flush()
+}
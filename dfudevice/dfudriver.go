@@ -1,10 +1,28 @@
 package dfudevice
 
+import "errors"
+
+//Errors drivers return from Control when the device stops answering, the DFU
+//layer expects them from devices that reset or detach on their own
+var (
+	//errNoDevice means the device is no longer on the bus
+	errNoDevice = errors.New("Device disconnected")
+	//errPipe means the request was stalled or dropped, as devices do when
+	//they leave the bus while the request is in progress
+	errPipe = errors.New("Control request stalled")
+)
+
 type dfuDriver interface {
-	List() []string
+	List(filter DeviceFilter) []string
+	ListRuntime(filter DeviceFilter) []string
+	Enumerate(filter DeviceFilter) ([]DeviceInfo, error)
 	Open(path string) (device DFUDevice, err error)
+	OpenRuntime(path string) (device DFUDevice, err error)
 	Control(rType, request uint8, val, idx uint16, data []byte) (int, error)
 	InterfaceDescription(cfgNum, intfNum, altNum int) (string, error)
+	FunctionalDescriptor(cfgNum, intfNum int) ([]byte, error)
+	SetAltSetting(intfNum, altNum int) error
+	Reset() error
 	Close()
 }
 
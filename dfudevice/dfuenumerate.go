@@ -0,0 +1,164 @@
+package dfudevice
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DeviceMode tells how a device is enumerated
+type DeviceMode int
+
+const (
+	// DeviceModeApplication is a device without any DFU interface
+	DeviceModeApplication DeviceMode = iota
+	// DeviceModeRuntime is an application with a DFU runtime interface
+	DeviceModeRuntime
+	// DeviceModeDFU is a device in DFU mode, usually its bootloader
+	DeviceModeDFU
+)
+
+func (m DeviceMode) String() string {
+	switch m {
+	case DeviceModeApplication:
+		return "application"
+	case DeviceModeRuntime:
+		return "runtime"
+	case DeviceModeDFU:
+		return "DFU"
+	}
+	return fmt.Sprintf("DeviceMode(%d)", int(m))
+}
+
+// DeviceInfo identifies a physical device on the bus
+type DeviceInfo struct {
+	Path   string
+	VID    uint16
+	PID    uint16
+	Serial string
+	Mode   DeviceMode
+
+	//Address is the bus address, a new one is assigned on every enumeration.
+	//0 when the driver cannot tell.
+	Address int
+}
+
+// Enumerate lists the devices matching filter in any mode. It fails when a
+// driver can only see devices in DFU mode, such as the Windows ST driver.
+func Enumerate(filter DeviceFilter) ([]DeviceInfo, error) {
+	result := make([]DeviceInfo, 0)
+	for _, driver := range dfuDriverList {
+		devices, err := driver.Enumerate(filter)
+
+		if err != nil {
+			return result, err
+		}
+
+		result = append(result, devices...)
+	}
+	return result, nil
+}
+
+// Info returns how the opened device is currently enumerated, take it before
+// the device resets to find it again with WaitForDevice
+func (d DFUDevice) Info() (DeviceInfo, error) {
+	devices, err := Enumerate(DeviceFilter{})
+
+	if err != nil {
+		return DeviceInfo{Path: d.path}, err
+	}
+
+	for _, info := range devices {
+		if info.Path == d.path {
+			return info, nil
+		}
+	}
+	return DeviceInfo{Path: d.path}, fmt.Errorf("Device %s is not enumerated", d.path)
+}
+
+// findDevice looks for the physical device of info, by serial number first
+// as the path may change with the mode on some drivers
+func findDevice(info DeviceInfo) (DeviceInfo, bool, error) {
+	devices, err := Enumerate(DeviceFilter{})
+
+	if err != nil {
+		return DeviceInfo{}, false, err
+	}
+
+	if info.Serial != "" {
+		for _, found := range devices {
+			if found.Serial == info.Serial {
+				return found, true, nil
+			}
+		}
+	}
+
+	for _, found := range devices {
+		if found.Path == info.Path {
+			return found, true, nil
+		}
+	}
+	return DeviceInfo{}, false, nil
+}
+
+// WaitForDevice waits up to timeout for the physical device described by info
+// to enumerate again after a reset and returns it as found, Mode tells whether
+// it came back as the application or in DFU mode. Devices are matched by
+// serial number or by port path.
+func WaitForDevice(info DeviceInfo, timeout time.Duration) (DeviceInfo, error) {
+	return waitForDevice(context.Background(), info, timeout)
+}
+
+// waitForDevice is WaitForDevice, giving up once ctx is done
+func waitForDevice(ctx context.Context, info DeviceInfo, timeout time.Duration) (DeviceInfo, error) {
+	deadline := time.Now().Add(timeout)
+	gone := false
+
+	for {
+		found, ok, err := findDevice(info)
+
+		if err != nil {
+			return DeviceInfo{}, err
+		}
+
+		if !ok {
+			gone = true
+		} else if gone {
+			return found, nil
+		} else if found.Path != info.Path || (info.Address != 0 && found.Address != info.Address) {
+			//Enumerated again between two polls
+			return found, nil
+		}
+
+		if time.Now().After(deadline) {
+			if ok {
+				return found, fmt.Errorf("Timed out waiting for %s to reset", info.Path)
+			}
+			return DeviceInfo{}, fmt.Errorf("Timed out waiting for %s to enumerate again", info.Path)
+		}
+
+		err = waitEnumerationPoll(ctx)
+
+		if err != nil {
+			return DeviceInfo{}, fmt.Errorf("Stopped waiting for %s: %v", info.Path, err)
+		}
+	}
+}
+
+// ExitDFUAndWait leaves DFU mode like ExitDFU and then waits up to timeout
+// for the device to enumerate again, reporting the mode it came back in
+func (d DFUDevice) ExitDFUAndWait(addr uint, timeout time.Duration) (DeviceInfo, error) {
+	info, err := d.Info()
+
+	if err != nil {
+		return DeviceInfo{}, err
+	}
+
+	err = d.ExitDFU(addr)
+
+	if err != nil {
+		return DeviceInfo{}, err
+	}
+
+	return waitForDevice(d.context(), info, timeout)
+}
@@ -0,0 +1,366 @@
+package dfudevice
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MemoryLayout is a run of equally sized pages (sectors) of device memory
+type MemoryLayout struct {
+	StartAddress uint
+	Pages        uint
+	PageSize     uint
+	Size         uint
+
+	//Sector permissions from the trailing a-g letter of the descriptor
+	Readable  bool
+	Erasable  bool
+	Writeable bool
+}
+
+//Sector type letters a-g encode these bits as letter-'a'+1
+const (
+	memReadable = 1 << iota
+	memErasable
+	memWriteable
+)
+
+func (m MemoryLayout) allows(access int) bool {
+	return (access&memReadable == 0 || m.Readable) &&
+		(access&memErasable == 0 || m.Erasable) &&
+		(access&memWriteable == 0 || m.Writeable)
+}
+
+func accessString(access int) string {
+	names := make([]string, 0)
+	if access&memReadable != 0 {
+		names = append(names, "readable")
+	}
+	if access&memErasable != 0 {
+		names = append(names, "erasable")
+	}
+	if access&memWriteable != 0 {
+		names = append(names, "writeable")
+	}
+	return strings.Join(names, " and ")
+}
+
+// Contains reports whether addr falls within the segment
+func (m MemoryLayout) Contains(addr uint) bool {
+	return addr >= m.StartAddress && addr-m.StartAddress < m.Size
+}
+
+// MemoryRegion is the memory reachable through one alternate setting, as
+// described by its DfuSe interface string
+type MemoryRegion struct {
+	Name       string
+	AltSetting int
+	Segments   []MemoryLayout
+}
+
+// Find returns the segment of the region that holds addr
+func (r MemoryRegion) Find(addr uint) (MemoryLayout, bool) {
+	for _, segment := range r.Segments {
+		if segment.Contains(addr) {
+			return segment, true
+		}
+	}
+	return MemoryLayout{}, false
+}
+
+// erasable reports whether any segment of the region can be erased
+func (r MemoryRegion) erasable() bool {
+	for _, segment := range r.Segments {
+		if segment.Erasable {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAccess verifies that every sector from addr to addr+length exists and
+// allows access, length 0 checks the single sector holding addr
+func (r MemoryRegion) checkAccess(addr, length uint, access int) error {
+	if length == 0 {
+		length = 1
+	}
+
+	for current := addr; current-addr < length; {
+		segment, found := r.Find(current)
+
+		if !found {
+			return fmt.Errorf("Address 0x%x is outside of the memory map of %s", current, r.Name)
+		}
+
+		if !segment.allows(access) {
+			return fmt.Errorf("Sector at 0x%x of %s is not %s", current, r.Name, accessString(access))
+		}
+
+		current = segment.StartAddress + segment.Size
+
+		//Last segment ends at the top of the address space
+		if current == 0 {
+			break
+		}
+	}
+
+	return nil
+}
+
+// sectors returns the start address of every sector touched by the range
+// addr to addr+length, whatever the size of the sectors or the segment they
+// belong to
+func (r MemoryRegion) sectors(addr, length uint) ([]uint, error) {
+	sectors := make([]uint, 0)
+
+	for current := addr; current-addr < length; {
+		segment, found := r.Find(current)
+
+		if !found {
+			return sectors, fmt.Errorf("Address 0x%x is outside of the memory map of %s", current, r.Name)
+		}
+
+		page := (current - segment.StartAddress) / segment.PageSize
+		for ; page < segment.Pages; page++ {
+			pageAddr := segment.StartAddress + page*segment.PageSize
+			if pageAddr >= addr && pageAddr-addr >= length {
+				break
+			}
+			sectors = append(sectors, pageAddr)
+		}
+
+		current = segment.StartAddress + segment.Size
+
+		if current == 0 {
+			break
+		}
+	}
+
+	return sectors, nil
+}
+
+// nearest returns the segment allowing access that lies closest to the
+// range addr to addr+length
+func (r MemoryRegion) nearest(addr, length uint, access int) (MemoryLayout, bool) {
+	var best MemoryLayout
+	var bestDistance uint
+	found := false
+
+	for _, segment := range r.Segments {
+		if !segment.allows(access) {
+			continue
+		}
+
+		var distance uint
+		if segment.StartAddress >= addr+length {
+			distance = segment.StartAddress - (addr + length)
+		} else if segment.StartAddress+segment.Size <= addr {
+			distance = addr - (segment.StartAddress + segment.Size)
+		}
+
+		if !found || distance < bestDistance {
+			best, bestDistance, found = segment, distance, true
+		}
+	}
+
+	return best, found
+}
+
+// BoundsError is returned when a target of an image does not lie entirely
+// within memory the device allows it to be written to
+type BoundsError struct {
+	Target  int
+	Address uint
+	Size    uint
+	Region  string
+
+	//Closest segment that could hold the target, HasNearest is false when
+	//the region has no such segment at all
+	Nearest    MemoryLayout
+	HasNearest bool
+
+	Err error
+}
+
+func (e *BoundsError) Error() string {
+	msg := fmt.Sprintf("Target %d at 0x%x with size %d does not fit in %s: %v", e.Target, e.Address, e.Size, e.Region, e.Err)
+
+	if e.HasNearest {
+		msg += fmt.Sprintf(", nearest valid segment is 0x%x-0x%x", e.Nearest.StartAddress, e.Nearest.StartAddress+e.Nearest.Size-1)
+	}
+
+	return msg
+}
+
+func (e *BoundsError) Unwrap() error {
+	return e.Err
+}
+
+// MemoryMap holds the memory regions of every alternate setting of a device
+type MemoryMap []MemoryRegion
+
+// Region returns the memory region behind alternate setting alt
+func (m MemoryMap) Region(alt int) (MemoryRegion, bool) {
+	for _, region := range m {
+		if region.AltSetting == alt {
+			return region, true
+		}
+	}
+	return MemoryRegion{}, false
+}
+
+// Find searches every region for the segment that holds addr
+func (m MemoryMap) Find(addr uint) (MemoryRegion, MemoryLayout, bool) {
+	for _, region := range m {
+		if segment, ok := region.Find(addr); ok {
+			return region, segment, true
+		}
+	}
+	return MemoryRegion{}, MemoryLayout{}, false
+}
+
+//   N*SSSMt     N pages of SSS units, M is the unit (' ', B, K or M) and t is
+//               the sector type a-g
+var segmentRegex = regexp.MustCompile(`^\s*(\d+)\*(\d+)\s*([BKM]?)\s*([a-gA-G]?)\s*$`)
+
+// parseMemoryDescriptor decodes a DfuSe memory descriptor of the form
+// @Name/0xADDR/N*SSKg,M*SSKg/0xADDR2/N*SSKg
+func parseMemoryDescriptor(alt int, desc string) (region MemoryRegion, err error) {
+	region.AltSetting = alt
+
+	desc = strings.TrimRight(desc, "\x00")
+	descValues := strings.Split(desc, "/")
+
+	if len(descValues) < 3 || len(descValues)%2 == 0 || !strings.HasPrefix(descValues[0], "@") {
+		return region, fmt.Errorf("Bad descriptor returned from usb device, unable to parse memory map: %q", desc)
+	}
+
+	region.Name = strings.TrimSpace(descValues[0][1:])
+	region.Segments = make([]MemoryLayout, 0)
+
+	for block := 1; block < len(descValues); block += 2 {
+		addr, err := strconv.ParseUint(strings.TrimSpace(descValues[block]), 0, 32)
+
+		if err != nil {
+			return region, fmt.Errorf("Bad address %q in memory descriptor %q: %v", descValues[block], desc, err)
+		}
+
+		for _, segment := range strings.Split(descValues[block+1], ",") {
+			segMatches := segmentRegex.FindStringSubmatch(segment)
+
+			if segMatches == nil {
+				return region, fmt.Errorf("Bad segment %q in memory descriptor %q", segment, desc)
+			}
+
+			//Sizes are zero padded decimal, base 0 would read them as octal
+			numPages, err := strconv.ParseUint(segMatches[1], 10, 32)
+			if err != nil {
+				return region, fmt.Errorf("Bad page count in segment %q: %v", segment, err)
+			}
+			pageSize, err := strconv.ParseUint(segMatches[2], 10, 32)
+			if err != nil {
+				return region, fmt.Errorf("Bad page size in segment %q: %v", segment, err)
+			}
+
+			if pageSize == 0 {
+				return region, fmt.Errorf("Zero page size in segment %q", segment)
+			}
+
+			switch segMatches[3] {
+			case "K":
+				pageSize *= 1024
+			case "M":
+				pageSize *= 1024 * 1024
+			}
+
+			//A missing sector type is treated as fully accessible
+			access := memReadable | memErasable | memWriteable
+			if segMatches[4] != "" {
+				access = int(strings.ToLower(segMatches[4])[0]-'a') + 1
+			}
+
+			var mem MemoryLayout
+			mem.StartAddress = uint(addr)
+			mem.Pages = uint(numPages)
+			mem.PageSize = uint(pageSize)
+			mem.Size = mem.Pages * mem.PageSize
+			mem.Readable = access&memReadable != 0
+			mem.Erasable = access&memErasable != 0
+			mem.Writeable = access&memWriteable != 0
+
+			region.Segments = append(region.Segments, mem)
+
+			addr += uint64(mem.Size)
+		}
+	}
+
+	return region, nil
+}
+
+// GetMemoryRegion reads and parses the memory descriptor of alternate setting alt
+func (d DFUDevice) GetMemoryRegion(alt int) (MemoryRegion, error) {
+	if d.dev == nil {
+		return MemoryRegion{}, fmt.Errorf("GetMemoryRegion(): Device not initialized")
+	}
+
+	desc, err := d.dev.InterfaceDescription(d.cfgNum, d.intfNum, alt)
+
+	if err != nil {
+		return MemoryRegion{}, fmt.Errorf("Failed to read memory descriptor of alt setting %d: %v", alt, err)
+	}
+
+	return parseMemoryDescriptor(alt, desc)
+}
+
+// checkAccess refuses operations the memory map of the selected alternate
+// setting does not allow, before anything is sent to the device
+func (d DFUDevice) checkAccess(addr, length uint, access int) error {
+	region, err := d.GetMemoryRegion(d.altSetting)
+
+	if err != nil {
+		return err
+	}
+
+	return region.checkAccess(addr, length, access)
+}
+
+// GetMemoryMap parses the memory descriptor of every alternate setting of the
+// DFU interface
+func (d DFUDevice) GetMemoryMap() (MemoryMap, error) {
+	memMap := make(MemoryMap, 0)
+
+	//Alternate settings are numbered from 0, stop at the first one missing
+	for alt := 0; alt < 256; alt++ {
+		if d.dev == nil {
+			return memMap, fmt.Errorf("GetMemoryMap(): Device not initialized")
+		}
+
+		desc, err := d.dev.InterfaceDescription(d.cfgNum, d.intfNum, alt)
+
+		if err != nil {
+			if alt == 0 {
+				return memMap, fmt.Errorf("Failed to read memory descriptor: %v", err)
+			}
+			break
+		}
+
+		region, err := parseMemoryDescriptor(alt, desc)
+
+		if err != nil {
+			return memMap, err
+		}
+
+		memMap = append(memMap, region)
+	}
+
+	return memMap, nil
+}
+
+// GetMemoryLayout returns the segments of the currently selected alternate setting
+func (d DFUDevice) GetMemoryLayout() (mem []MemoryLayout, err error) {
+	region, err := d.GetMemoryRegion(d.altSetting)
+
+	return region.Segments, err
+}
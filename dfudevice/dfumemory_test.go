@@ -0,0 +1,250 @@
+package dfudevice
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/willtoth/go-dfuse/dfufile"
+)
+
+//Memory layout of an STM32F4 bootloader, with an external flash on a third
+//alt setting for the tests that need a second erasable memory
+const (
+	testFlash         = "@Internal Flash  /0x08000000/04*016Kg,01*064Kg,07*128Kg"
+	testOptionBytes   = "@Option Bytes  /0x1FFFC000/01*016 e"
+	testExternalFlash = "@SPI Flash  /0x90000000/64*04Kg"
+)
+
+func testSegment(start, pages, pageSize uint, access int) MemoryLayout {
+	return MemoryLayout{
+		StartAddress: start,
+		Pages:        pages,
+		PageSize:     pageSize,
+		Size:         pages * pageSize,
+		Readable:     access&memReadable != 0,
+		Erasable:     access&memErasable != 0,
+		Writeable:    access&memWriteable != 0,
+	}
+}
+
+func TestParseMemoryDescriptor(t *testing.T) {
+	const all = memReadable | memErasable | memWriteable
+
+	tests := []struct {
+		name     string
+		desc     string
+		expected MemoryRegion
+		errText  string
+	}{
+		{
+			name: "sectors of different sizes",
+			desc: testFlash,
+			expected: MemoryRegion{Name: "Internal Flash", Segments: []MemoryLayout{
+				testSegment(0x08000000, 4, 16*1024, all),
+				testSegment(0x08010000, 1, 64*1024, all),
+				testSegment(0x08020000, 7, 128*1024, all),
+			}},
+		},
+		{
+			name: "several address blocks",
+			desc: "@SRAM /0x20000000/02*016Kg,01*064Kg/0x10000000/04*016Ka",
+			expected: MemoryRegion{Name: "SRAM", Segments: []MemoryLayout{
+				testSegment(0x20000000, 2, 16*1024, all),
+				testSegment(0x20008000, 1, 64*1024, all),
+				testSegment(0x10000000, 4, 16*1024, memReadable),
+			}},
+		},
+		{
+			name: "zero padded sizes are decimal",
+			desc: "@Flash/0x08000000/010*0008Kg",
+			expected: MemoryRegion{Name: "Flash", Segments: []MemoryLayout{
+				testSegment(0x08000000, 10, 8*1024, all),
+			}},
+		},
+		{
+			name: "unit B",
+			desc: "@OTP Memory /0x1FFF7800/01*512Be,01*016Be",
+			expected: MemoryRegion{Name: "OTP Memory", Segments: []MemoryLayout{
+				testSegment(0x1fff7800, 1, 512, memReadable|memWriteable),
+				testSegment(0x1fff7a00, 1, 16, memReadable|memWriteable),
+			}},
+		},
+		{
+			name: "unit M",
+			desc: "@QSPI Flash /0x90000000/16*001Mg",
+			expected: MemoryRegion{Name: "QSPI Flash", Segments: []MemoryLayout{
+				testSegment(0x90000000, 16, 1024*1024, all),
+			}},
+		},
+		{
+			name: "no unit",
+			desc: testOptionBytes,
+			expected: MemoryRegion{Name: "Option Bytes", Segments: []MemoryLayout{
+				testSegment(0x1fffc000, 1, 16, memReadable|memWriteable),
+			}},
+		},
+		{
+			name: "missing sector type",
+			desc: "@Flash/0x08000000/04*016K",
+			expected: MemoryRegion{Name: "Flash", Segments: []MemoryLayout{
+				testSegment(0x08000000, 4, 16*1024, all),
+			}},
+		},
+		{
+			name: "trailing NULs",
+			desc: "@Flash/0x08000000/04*016Kg\x00\x00",
+			expected: MemoryRegion{Name: "Flash", Segments: []MemoryLayout{
+				testSegment(0x08000000, 4, 16*1024, all),
+			}},
+		},
+		{name: "no name", desc: "Flash/0x08000000/04*016Kg", errText: "unable to parse memory map"},
+		{name: "no segments", desc: "@Flash/0x08000000", errText: "unable to parse memory map"},
+		{name: "address without segments", desc: "@Flash/0x08000000/04*016Kg/0x1FFF0000", errText: "unable to parse memory map"},
+		{name: "bad address", desc: "@Flash/0x0800000g/04*016Kg", errText: "Bad address"},
+		{name: "malformed segment", desc: "@Flash/0x08000000/04x016Kg", errText: "Bad segment \"04x016Kg\""},
+		{name: "unknown sector type", desc: "@Flash/0x08000000/04*016Kz", errText: "Bad segment"},
+		{name: "empty segment", desc: "@Flash/0x08000000/04*016Kg,", errText: "Bad segment"},
+		{name: "zero page size", desc: "@Flash/0x08000000/04*000Kg", errText: "Zero page size"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			region, err := parseMemoryDescriptor(3, test.desc)
+
+			if test.errText != "" {
+				if err == nil || !strings.Contains(err.Error(), test.errText) {
+					t.Fatalf("expected an error containing %q, got %v", test.errText, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			test.expected.AltSetting = 3
+			if !reflect.DeepEqual(region, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, region)
+			}
+		})
+	}
+}
+
+func TestCheckBounds(t *testing.T) {
+	type span struct {
+		addr   uint32
+		length int
+	}
+
+	tests := []struct {
+		name    string
+		desc    string
+		targets []span
+		target  int
+		nearest uint
+		errText string
+	}{
+		{
+			name:    "fits across segments",
+			desc:    testFlash,
+			targets: []span{{0x08000000, 0x10}, {0x0800fff0, 0x20}},
+		},
+		{
+			name:    "past the end",
+			desc:    "@Flash/0x08000000/04*016Kg",
+			targets: []span{{0x0800fff0, 0x20}},
+			nearest: 0x08000000,
+			errText: "nearest valid segment is 0x8000000-0x800ffff",
+		},
+		{
+			name:    "below the start",
+			desc:    "@Flash/0x08000000/04*016Kg/0x08100000/01*016Kg",
+			targets: []span{{0x08000000, 0x10}, {0x07ffc000, 0x10}},
+			target:  1,
+			nearest: 0x08000000,
+			errText: "Target 1 at 0x7ffc000",
+		},
+		{
+			name:    "closer to a later block",
+			desc:    "@Flash/0x08000000/04*016Kg/0x08100000/01*016Kg",
+			targets: []span{{0x080f0000, 0x10}},
+			nearest: 0x08100000,
+			errText: "nearest valid segment is 0x8100000-0x8103fff",
+		},
+		{
+			name:    "read only sectors",
+			desc:    "@Flash/0x08000000/02*016Ka,02*016Kg",
+			targets: []span{{0x08000000, 0x10}},
+			nearest: 0x08008000,
+			errText: "not writeable",
+		},
+		{
+			name:    "nothing writeable",
+			desc:    "@Option Bytes/0x1FFFC000/01*016 a",
+			targets: []span{{0x1fffc000, 0x10}},
+			nearest: 0,
+			errText: "does not fit in Option Bytes",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			region, err := parseMemoryDescriptor(0, test.desc)
+
+			if err != nil {
+				t.Fatalf("parseMemoryDescriptor() failed: %v", err)
+			}
+
+			var image dfufile.DFUImage
+			for _, target := range test.targets {
+				var dfuTarget dfufile.DFUTarget
+				dfuTarget.Prefix.Address = target.addr
+				dfuTarget.Prefix.Size = uint32(target.length)
+				dfuTarget.Elements = make([]byte, target.length)
+				image.Targets = append(image.Targets, dfuTarget)
+			}
+
+			err = checkBounds(region, image, memWriteable)
+
+			if test.errText == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			var boundsErr *BoundsError
+			if !errors.As(err, &boundsErr) || !strings.Contains(err.Error(), test.errText) {
+				t.Fatalf("expected a BoundsError containing %q, got %v", test.errText, err)
+			}
+
+			if boundsErr.Target != test.target {
+				t.Errorf("expected target %d, got %d", test.target, boundsErr.Target)
+			}
+
+			if boundsErr.HasNearest != (test.nearest != 0) || boundsErr.Nearest.StartAddress != test.nearest {
+				t.Errorf("expected the nearest segment at 0x%x, got 0x%x (%v)", test.nearest, boundsErr.Nearest.StartAddress, boundsErr.HasNearest)
+			}
+		})
+	}
+
+	//A target whose size disagrees with its data is not a bounds problem
+	var image dfufile.DFUImage
+	image.Targets = []dfufile.DFUTarget{{Elements: make([]byte, 4)}}
+	image.Targets[0].Prefix.Address = 0x08000000
+	image.Targets[0].Prefix.Size = 8
+
+	flash, err := parseMemoryDescriptor(0, testFlash)
+
+	if err != nil {
+		t.Fatalf("parseMemoryDescriptor() failed: %v", err)
+	}
+
+	err = checkBounds(flash, image, memWriteable)
+
+	if err == nil || !strings.Contains(err.Error(), "Mismatch target size") {
+		t.Errorf("expected a size mismatch, got %v", err)
+	}
+}
@@ -0,0 +1,306 @@
+package dfudevice
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/willtoth/go-dfuse/dfufile"
+)
+
+//Plain DFU 1.1 has no addresses, blocks are numbered from 0 and the device
+//decides where they go. These are used when the functional descriptor does
+//not announce DfuSe (bcdDFUVersion 0x011a).
+
+// dnloadBlock sends one block of a plain DFU download and waits until the
+// device is ready for the next one
+func (d DFUDevice) dnloadBlock(blockNum uint16, buffer []byte) error {
+	ctx, cancel := d.commandContext()
+	defer cancel()
+
+	_, err := d.dev.Control(0x21, cmdDNLOAD, blockNum, uint16(d.intfNum), buffer)
+
+	if err != nil {
+		return fmt.Errorf("Control Transfer failed in dnload block %d: %v", blockNum, err)
+	}
+
+	for {
+		status, err := d.getStatus(ctx)
+
+		if err != nil {
+			d.abortOnTimeout(ctx)
+			return fmt.Errorf("Failed while polling status during dnload block %d: %v", blockNum, err)
+		}
+
+		switch status.bState {
+		case dfuStateDfuDownloadSync, dfuStateDfuDownloadBusy:
+			continue
+		case dfuStateDfuDownloadIdle:
+			return nil
+		case dfuStateDfuError:
+			return fmt.Errorf("Device failed dnload block %d, status: %d", blockNum, status.bStatus)
+		default:
+			return fmt.Errorf("Wrong state after dnload block %d, unexpected state: %d", blockNum, status.bState)
+		}
+	}
+}
+
+// Download writes data to a plain DFU 1.1 device in sequential blocks from
+// block 0 and then manifests it with a zero length DNLOAD
+func (d DFUDevice) Download(data []byte, progressMessage string) error {
+	if d.dev == nil {
+		return fmt.Errorf("Download(): Device not initialized")
+	}
+
+	if !d.functional.CanDownload() {
+		return fmt.Errorf("Download(): Device does not support download")
+	}
+
+	err := d.dnloadWaitOnIdle()
+
+	if err != nil {
+		return err
+	}
+
+	//block size, write in blocks of wTransferSize
+	transferSize := d.transferSize()
+
+	d.progressBars.setStatus(progressMessage)
+	d.progressBars.setMax(uint(len(data)))
+	d.progressBars.setIncrement(uint(transferSize))
+	d.progressBars.reset()
+
+	for blockNum := 0; blockNum*transferSize < len(data); blockNum++ {
+		dataSlice := data[blockNum*transferSize:]
+		if len(dataSlice) > transferSize {
+			dataSlice = dataSlice[:transferSize]
+		}
+
+		err = d.checkContext()
+
+		if err != nil {
+			return fmt.Errorf("Download stopped at offset 0x%x: %v", blockNum*transferSize, err)
+		}
+
+		d.progressBars.setIncrement(uint(len(dataSlice)))
+
+		//Block numbers wrap around on images over 128MB
+		err = d.dnloadBlock(uint16(blockNum), dataSlice)
+
+		if err != nil {
+			return fmt.Errorf("Download failed at offset 0x%x: %v", blockNum*transferSize, err)
+		}
+
+		d.progressBars.increment()
+	}
+
+	return d.manifest()
+}
+
+// manifest ends a plain DFU download. Manifestation tolerant devices return
+// to dfuIDLE, others wait for a USB reset or reset on their own.
+func (d DFUDevice) manifest() error {
+	ctx, cancel := d.commandContext()
+	defer cancel()
+
+	_, err := d.dev.Control(0x21, cmdDNLOAD, 0, uint16(d.intfNum), nil)
+
+	if err != nil {
+		return fmt.Errorf("Control Transfer failed when ending download: %v", err)
+	}
+
+	manifesting := false
+	for {
+		status, err := d.getStatus(ctx)
+
+		if err != nil {
+			//Devices that reset themselves stop answering once manifesting
+			if manifesting && ctx.Err() == nil {
+				return nil
+			}
+			return fmt.Errorf("Failed to get status after download: %v", err)
+		}
+
+		switch status.bState {
+		case dfuStateDfuManifestSync, dfuStateDfuManifest:
+			manifesting = true
+		case dfuStateDfuIdle, dfuStateDfuManifestWaitReset:
+			return nil
+		case dfuStateDfuError:
+			return fmt.Errorf("Device failed to manifest the download, status: %d", status.bStatus)
+		default:
+			return fmt.Errorf("Wrong state after download, unexpected state: %d", status.bState)
+		}
+	}
+}
+
+// Upload reads up to maxLength bytes from a plain DFU 1.1 device in
+// sequential blocks from block 0. The device ends the upload early with a
+// short block, so the result may be shorter than maxLength.
+func (d DFUDevice) Upload(maxLength uint, progressMessage string) ([]byte, error) {
+	if d.dev == nil {
+		return nil, fmt.Errorf("Upload(): Device not initialized")
+	}
+
+	if !d.functional.CanUpload() {
+		return nil, fmt.Errorf("Upload(): Device does not support upload")
+	}
+
+	err := d.uploadWaitOnIdle()
+
+	if err != nil {
+		return nil, err
+	}
+
+	//block size, read in blocks of wTransferSize
+	transferSize := uint(d.transferSize())
+	data := make([]byte, maxLength)
+
+	d.progressBars.setStatus(progressMessage)
+	d.progressBars.setMax(maxLength)
+	d.progressBars.setIncrement(transferSize)
+	d.progressBars.reset()
+
+	read := uint(0)
+	for blockNum := 0; read < maxLength; blockNum++ {
+		err = d.checkContext()
+
+		if err != nil {
+			return data[:read], fmt.Errorf("Upload stopped at offset 0x%x: %v", read, err)
+		}
+
+		dataSlice := data[read:]
+		if uint(len(dataSlice)) > transferSize {
+			dataSlice = dataSlice[:transferSize]
+		}
+
+		n, err := d.dev.Control(0xA1, cmdUPLOAD, uint16(blockNum), uint16(d.intfNum), dataSlice)
+
+		if err != nil {
+			return data[:read], fmt.Errorf("Upload failed at offset 0x%x: %v", read, err)
+		}
+
+		d.progressBars.setIncrement(uint(n))
+		d.progressBars.increment()
+		read += uint(n)
+
+		//A short block ends the upload, the device is back in dfuIDLE
+		if uint(n) < transferSize {
+			return data[:read], nil
+		}
+	}
+
+	//Stopped before the device did, return it to dfuIDLE
+	err = d.Abort()
+
+	if err != nil {
+		return data, fmt.Errorf("Failed to abort upload: %v", err)
+	}
+
+	return data, nil
+}
+
+// exitPlain leaves DFU mode on a plain DFU device. Plain DFU has no leave
+// command, the download manifests and then the device either resets itself
+// or waits for a USB reset.
+func (d DFUDevice) exitPlain() error {
+	status, err := d.GetStatus()
+
+	//Already reset after manifesting
+	if errors.Is(err, errNoDevice) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to leave DFU mode: %v", err)
+	}
+
+	switch status.bState {
+	case dfuStateDfuManifestSync, dfuStateDfuManifest:
+		return nil
+	}
+
+	err = d.dev.Reset()
+
+	if err != nil {
+		return fmt.Errorf("Failed to leave DFU mode, USB reset failed: %v", err)
+	}
+	return nil
+}
+
+// plainImageData joins the targets of dfuImage into the single contiguous
+// block of data a plain DFU device expects
+func plainImageData(dfuImage dfufile.DFUImage) ([]byte, error) {
+	targets := make([]dfufile.DFUTarget, len(dfuImage.Targets))
+	copy(targets, dfuImage.Targets)
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Prefix.Address < targets[j].Prefix.Address })
+
+	var data bytes.Buffer
+	for idx, target := range targets {
+		if idx > 0 {
+			end := targets[idx-1].Prefix.Address + uint32(len(targets[idx-1].Elements))
+			if target.Prefix.Address != end {
+				return nil, fmt.Errorf("Plain DFU image must be contiguous, gap between 0x%x and 0x%x", end, target.Prefix.Address)
+			}
+		}
+		data.Write(target.Elements)
+	}
+
+	return data.Bytes(), nil
+}
+
+// writePlain downloads dfuImage to a plain DFU device, which erases on its own
+func writePlain(dfuImage dfufile.DFUImage, dfuDevice DFUDevice, options WriteOptions, result *WriteResult) error {
+	if options.Differential {
+		return fmt.Errorf("Differential writes need a DfuSe device")
+	}
+
+	data, err := plainImageData(dfuImage)
+
+	if err != nil {
+		return err
+	}
+
+	err = dfuDevice.Download(data, "Writing Image")
+
+	if err != nil {
+		//The download is a single transfer, the first target carries the error
+		if len(result.Targets) > 0 {
+			result.Targets[0].Err = err
+		}
+		return err
+	}
+
+	for idx := range result.Targets {
+		result.Targets[idx].BytesWritten = result.Targets[idx].Size
+	}
+	return nil
+}
+
+// verifyPlain uploads the image from a plain DFU device and compares it
+func verifyPlain(dfuImage dfufile.DFUImage, dfuDevice DFUDevice) (bool, error) {
+	data, err := plainImageData(dfuImage)
+
+	if err != nil {
+		return false, err
+	}
+
+	status, err := dfuDevice.GetStatus()
+
+	if err != nil {
+		return false, err
+	}
+
+	if status.bState == dfuStateDfuManifestWaitReset {
+		return false, fmt.Errorf("Device has to be reset before it can be read back")
+	}
+
+	deviceData, err := dfuDevice.Upload(uint(len(data)), "Verifying Image")
+
+	if err != nil {
+		return false, fmt.Errorf("Verify failed to read device memory: %v", err)
+	}
+
+	return bytes.Equal(deviceData, data), nil
+}
@@ -0,0 +1,144 @@
+package dfudevice
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// enumerationPoll is how often the bus is checked for a re-enumerated device
+const enumerationPoll = 100 * time.Millisecond
+
+// waitEnumerationPoll sleeps for enumerationPoll, returning early when ctx is
+// done
+func waitEnumerationPoll(ctx context.Context) error {
+	timer := time.NewTimer(enumerationPoll)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// ListRuntime returns the paths of devices running their application with a
+// DFU runtime interface, each path can be passed to DetachToDFU
+func ListRuntime(filter DeviceFilter) []string {
+	result := make([]string, 0)
+	for _, driver := range dfuDriverList {
+		result = append(result, driver.ListRuntime(filter)...)
+	}
+	return result
+}
+
+// OpenRuntime opens the DFU runtime interface of a device in application
+// mode, the only request it supports is Detach
+func OpenRuntime(path string) (device DFUDevice, err error) {
+	//Return the first successful opened driver
+	for _, driver := range dfuDriverList {
+		device, err = driver.OpenRuntime(path)
+		if err == nil {
+			device.path = path
+			device.trackAltSetting()
+			err = device.loadFunctionalDescriptor()
+
+			if err != nil {
+				device.Close()
+				return DFUDevice{}, err
+			}
+			break
+		}
+	}
+	return
+}
+
+// Detach asks a device opened with OpenRuntime to switch to DFU mode. The
+// device then waits up to wDetachTimeOut for a USB reset, which is issued
+// here unless the device detaches on its own (bitWillDetach). The device
+// re-enumerates afterwards, so d cannot be used anymore.
+func (d DFUDevice) Detach() error {
+	if d.dev == nil {
+		return fmt.Errorf("Detach(): Device not initialized")
+	}
+
+	_, err := d.dev.Control(0x21, cmdDETACH, d.functional.DetachTimeout, uint16(d.intfNum), nil)
+
+	//The device may drop off the bus before acknowledging the request
+	if d.functional.WillDetach() && (err == errNoDevice || err == errPipe) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("Control Transfer failed in detach: %v", err)
+	}
+
+	if d.functional.WillDetach() {
+		return nil
+	}
+
+	err = d.dev.Reset()
+
+	if err != nil {
+		return fmt.Errorf("USB reset after detach failed: %v", err)
+	}
+	return nil
+}
+
+// DetachToDFU switches the runtime mode device at path into DFU mode and
+// waits up to timeout for it to re-enumerate, returning it opened in DFU mode
+func DetachToDFU(path string, timeout time.Duration) (DFUDevice, error) {
+	return detachToDFU(context.Background(), path, timeout)
+}
+
+// detachToDFU is DetachToDFU, giving up on the wait once ctx is done
+func detachToDFU(ctx context.Context, path string, timeout time.Duration) (DFUDevice, error) {
+	deadline := time.Now().Add(timeout)
+
+	runtimeDevice, err := OpenRuntime(path)
+
+	if err != nil {
+		return DFUDevice{}, fmt.Errorf("Failed to open runtime device %s: %v", path, err)
+	}
+
+	err = runtimeDevice.Detach()
+	runtimeDevice.Close()
+
+	if err != nil {
+		return DFUDevice{}, err
+	}
+
+	return openWhenEnumerated(ctx, path, deadline)
+}
+
+// openWhenEnumerated waits for the device at path to show up in DFU mode and
+// opens it. Opening is retried until deadline as the device node may not be
+// accessible as soon as it appears.
+func openWhenEnumerated(ctx context.Context, path string, deadline time.Time) (DFUDevice, error) {
+	lastErr := fmt.Errorf("device did not enumerate in DFU mode")
+
+	for {
+		for _, listed := range ListFiltered(DeviceFilter{}) {
+			if listed != path {
+				continue
+			}
+
+			device, err := Open(path)
+			if err == nil {
+				return device, nil
+			}
+			lastErr = err
+		}
+
+		if time.Now().After(deadline) {
+			return DFUDevice{}, fmt.Errorf("Timed out waiting for %s: %v", path, lastErr)
+		}
+
+		err := waitEnumerationPoll(ctx)
+
+		if err != nil {
+			return DFUDevice{}, fmt.Errorf("Stopped waiting for %s: %v", path, err)
+		}
+	}
+}
@@ -3,77 +3,348 @@ package dfudevice
 import (
 	"bytes"
 	"fmt"
-	"math"
+	"sort"
 
 	"github.com/willtoth/go-dfuse/dfufile"
 )
 
-func WriteImage(dfuImage dfufile.DFUImage, dfuDevice DFUDevice) error {
-	massErase := false
+// EraseMode selects how memory is erased before an image is written
+type EraseMode int
 
-	mem, err := dfuDevice.GetMemoryLayout()
+const (
+	// EraseModePages erases only the pages covered by the image
+	EraseModePages EraseMode = iota
+	// EraseModeMass erases the whole memory with a single command
+	EraseModeMass
+	// EraseModeNone writes without erasing, the memory must already be blank
+	EraseModeNone
+)
 
-	//TODO: This should search mem[] for the correct location
-	memory := mem[0]
+func (e EraseMode) String() string {
+	switch e {
+	case EraseModePages:
+		return "page"
+	case EraseModeMass:
+		return "mass"
+	case EraseModeNone:
+		return "none"
+	}
+	return fmt.Sprintf("EraseMode(%d)", int(e))
+}
 
-	//Check that target fits within mem
-	//if uint(dfuImage.Prefix.Address+dfuTarget.Prefix.Size) > mem[0].StartAddress+mem[0].Size {
-	//	return fmt.Errorf("Target address of %x and size of %d will not fit within specified device.",
-	//		dfuTarget.Prefix.Address, dfuTarget.Prefix.Size)
-	//}
+// WriteOptions controls how WriteImageWithOptions and WriteFileWithOptions
+// program the device, the zero value erases page by page
+type WriteOptions struct {
+	Erase EraseMode
 
-	//fmt.Printf("Writing to device starting at page 0x%x\r\n", dfuTarget.Prefix.Address)
+	//Differential reads every page first and skips erasing and writing the
+	//pages that already hold the image, it cannot be used with EraseModeMass
+	Differential bool
+}
 
-	//fmt.Println("Erasing pages...")
+// TargetResult reports what happened to one target of an image
+type TargetResult struct {
+	Target  int
+	Address uint
+	Size    uint
 
-	if massErase == true {
-		err = dfuDevice.MassErase()
+	//BytesWritten were programmed, BytesSkipped already matched the device
+	//during a differential write
+	BytesWritten uint
+	BytesSkipped uint
+
+	//Err is set on the target that failed, targets after it are untouched
+	Err error
+}
+
+// Done reports whether the target now holds its data on the device
+func (t TargetResult) Done() bool {
+	return t.Err == nil && t.BytesWritten+t.BytesSkipped == t.Size
+}
+
+// WriteResult lists every target of an image written by WriteImageWithOptions
+type WriteResult struct {
+	AltSetting int
+	Targets    []TargetResult
+}
+
+func newWriteResult(dfuImage dfufile.DFUImage) WriteResult {
+	result := WriteResult{AltSetting: int(dfuImage.Prefix.AltSetting)}
+	result.Targets = make([]TargetResult, len(dfuImage.Targets))
+
+	for idx, target := range dfuImage.Targets {
+		result.Targets[idx].Target = idx
+		result.Targets[idx].Address = uint(target.Prefix.Address)
+		result.Targets[idx].Size = uint(len(target.Elements))
+	}
+
+	return result
+}
+
+// WriteFile writes every image of dfuFile in order, each to the alternate
+// setting named in its prefix
+func WriteFile(dfuFile dfufile.DFUFile, dfuDevice DFUDevice) error {
+	_, err := WriteFileWithOptions(dfuFile, dfuDevice, WriteOptions{})
+	return err
+}
+
+// WriteFileWithOptions is WriteFile with explicit options. Every image is
+// checked against the memory map of its alternate setting before anything is
+// erased. A mass erase wipes a whole memory, so each memory the file writes to
+// is mass erased once up front and the images are then written without
+// erasing. The results hold one entry per image attempted, including the
+// failing one.
+func WriteFileWithOptions(dfuFile dfufile.DFUFile, dfuDevice DFUDevice, options WriteOptions) ([]WriteResult, error) {
+	results := make([]WriteResult, 0, len(dfuFile.Images))
+
+	if dfuDevice.IsDfuSe() {
+		err := checkFileBounds(dfuFile, dfuDevice)
+
+		if err != nil {
+			return results, err
+		}
+	}
+
+	//Differential writes refuse a mass erase in WriteImageWithOptions
+	if options.Erase == EraseModeMass && !options.Differential && dfuDevice.IsDfuSe() {
+		err := massEraseFile(dfuFile, dfuDevice)
+
+		if err != nil {
+			return results, err
+		}
+
+		options.Erase = EraseModeNone
+	}
+
+	for idx, image := range dfuFile.Images {
+		result, err := WriteImageWithOptions(image, dfuDevice, options)
+		results = append(results, result)
+
+		if err != nil {
+			return results, fmt.Errorf("Failed to write image %d (alt setting %d): %v", idx, image.Prefix.AltSetting, err)
+		}
+	}
+	return results, nil
+}
+
+// checkFileBounds runs checkBounds on every image of dfuFile, each against the
+// memory of its own alternate setting
+func checkFileBounds(dfuFile dfufile.DFUFile, dfuDevice DFUDevice) error {
+	for idx, image := range dfuFile.Images {
+		region, err := dfuDevice.GetMemoryRegion(int(image.Prefix.AltSetting))
+
+		if err == nil {
+			err = checkBounds(region, image, memWriteable)
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed to write image %d (alt setting %d): %w", idx, image.Prefix.AltSetting, err)
+		}
+	}
+	return nil
+}
+
+// massEraseFile sends one mass erase to every alternate setting dfuFile writes
+// to, skipping memories without erasable sectors such as option bytes
+func massEraseFile(dfuFile dfufile.DFUFile, dfuDevice DFUDevice) error {
+	erased := make(map[int]bool)
+
+	for _, image := range dfuFile.Images {
+		alt := int(image.Prefix.AltSetting)
+		if erased[alt] {
+			continue
+		}
+		erased[alt] = true
+
+		region, err := dfuDevice.GetMemoryRegion(alt)
 
 		if err != nil {
 			return err
 		}
-	} else {
-		for _, target := range dfuImage.Targets {
-			startPage := -1
-			pagesToErase := uint(math.Ceil(float64(target.Prefix.Size) / float64(memory.PageSize)))
 
-			if int(target.Prefix.Size) != len(target.Elements) {
-				return fmt.Errorf("Mismatch target size, size claims %d, but has %d elements", target.Prefix.Size, len(target.Elements))
-			}
+		if !region.erasable() {
+			continue
+		}
 
-			for idx := uint(0); idx < memory.Pages; idx++ {
-				//Target should be at page boundary
-				if memory.StartAddress+(idx*memory.PageSize) == uint(target.Prefix.Address) {
-					startPage = int(idx)
-					break
-				}
-			}
+		err = dfuDevice.SelectAltSetting(alt)
 
-			if startPage == -1 {
-				return fmt.Errorf("Failed to find target address %x in device memory", target.Prefix.Address)
-			}
+		if err != nil {
+			return err
+		}
+
+		err = dfuDevice.MassErase()
+
+		if err != nil {
+			return fmt.Errorf("Failed to mass erase alt setting %d: %v", alt, err)
+		}
+	}
+	return nil
+}
+
+// VerifyFile checks every image of dfuFile against device memory
+func VerifyFile(dfuFile dfufile.DFUFile, dfuDevice DFUDevice) (bool, error) {
+	for idx, image := range dfuFile.Images {
+		verify, err := VerifyImage(image, dfuDevice)
+
+		if err != nil {
+			return false, fmt.Errorf("Failed to verify image %d (alt setting %d): %v", idx, image.Prefix.AltSetting, err)
+		}
+
+		if verify == false {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func WriteImage(dfuImage dfufile.DFUImage, dfuDevice DFUDevice) error {
+	_, err := WriteImageWithOptions(dfuImage, dfuDevice, WriteOptions{})
+	return err
+}
+
+// WriteImageWithOptions erases according to options.Erase and then writes
+// every target of dfuImage, stopping at the first target that fails
+func WriteImageWithOptions(dfuImage dfufile.DFUImage, dfuDevice DFUDevice, options WriteOptions) (WriteResult, error) {
+	result := newWriteResult(dfuImage)
+
+	err := dfuDevice.SelectAltSetting(int(dfuImage.Prefix.AltSetting))
+
+	if err != nil {
+		return result, err
+	}
+
+	if !dfuDevice.functional.CanDownload() {
+		return result, fmt.Errorf("Device does not support download")
+	}
 
-			err := dfuDevice.MultiPageErase(uint(target.Prefix.Address), pagesToErase, memory.PageSize, "Erasing Pages")
+	if !dfuDevice.IsDfuSe() {
+		err = writePlain(dfuImage, dfuDevice, options, &result)
+		return result, err
+	}
+
+	region, err := dfuDevice.GetMemoryRegion(int(dfuImage.Prefix.AltSetting))
+
+	if err != nil {
+		return result, err
+	}
+
+	//Refuse the whole image before erasing anything. Sectors that cannot be
+	//erased (option bytes) are written as they are, like dfu-util does.
+	err = checkBounds(region, dfuImage, memWriteable)
+
+	if err != nil {
+		return result, err
+	}
+
+	if options.Differential {
+		err = writeDifferential(dfuImage, dfuDevice, region, options, &result)
+		return result, err
+	}
+
+	switch options.Erase {
+	case EraseModeMass:
+		//Nothing to erase on memory such as option bytes
+		if region.erasable() {
+			err = dfuDevice.MassErase()
 
 			if err != nil {
-				return err
+				return result, err
 			}
+		}
+	case EraseModePages:
+		pages, err := planErase(region, dfuImage.Targets)
 
+		if err != nil {
+			return result, err
 		}
-	}
 
-	//fmt.Println("Writing pages...")
+		err = dfuDevice.ErasePages(pages, "Erasing Pages")
+
+		if err != nil {
+			return result, err
+		}
+	case EraseModeNone:
+	default:
+		return result, fmt.Errorf("Unknown erase mode %v", options.Erase)
+	}
 
 	//By this point, the appropriate amount of flash has been erased, write each target
-	for _, target := range dfuImage.Targets {
-		//fmt.Printf("Writing to address 0x%x\r\n", target.Prefix.Address)
-		dfuDevice.WriteMemory(uint(target.Prefix.Address), target.Elements, "Writing Image")
+	for idx, target := range dfuImage.Targets {
+		err = dfuDevice.WriteMemory(uint(target.Prefix.Address), target.Elements, "Writing Image")
+
+		if err != nil {
+			result.Targets[idx].Err = err
+			return result, fmt.Errorf("Failed to write target %d at 0x%x: %v", idx, target.Prefix.Address, err)
+		}
+
+		result.Targets[idx].BytesWritten = uint(len(target.Elements))
 	}
 
-	return err
+	return result, nil
+}
+
+// checkBounds makes sure every target of dfuImage lies entirely within
+// segments of region that allow access, returning a *BoundsError otherwise
+func checkBounds(region MemoryRegion, dfuImage dfufile.DFUImage, access int) error {
+	for idx, target := range dfuImage.Targets {
+		if int(target.Prefix.Size) != len(target.Elements) {
+			return fmt.Errorf("Mismatch target size, size claims %d, but has %d elements", target.Prefix.Size, len(target.Elements))
+		}
+
+		addr, size := uint(target.Prefix.Address), uint(len(target.Elements))
+		err := region.checkAccess(addr, size, access)
+
+		if err != nil {
+			boundsErr := &BoundsError{Target: idx, Address: addr, Size: size, Region: region.Name, Err: err}
+			boundsErr.Nearest, boundsErr.HasNearest = region.nearest(addr, size, access)
+			return boundsErr
+		}
+	}
+	return nil
+}
+
+// planErase works out every sector that has to be erased before targets can
+// be written, including sectors a target only starts or ends partway into.
+// Sectors that are not erasable are left out.
+func planErase(region MemoryRegion, targets []dfufile.DFUTarget) ([]uint, error) {
+	pages := make([]uint, 0)
+	seen := make(map[uint]bool)
+
+	for _, target := range targets {
+		targetPages, err := region.sectors(uint(target.Prefix.Address), uint(len(target.Elements)))
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to find target address %x in device memory: %v", target.Prefix.Address, err)
+		}
+
+		for _, page := range targetPages {
+			if segment, _ := region.Find(page); !segment.Erasable {
+				continue
+			}
+
+			if !seen[page] {
+				seen[page] = true
+				pages = append(pages, page)
+			}
+		}
+	}
+
+	sort.Slice(pages, func(i, j int) bool { return pages[i] < pages[j] })
+
+	return pages, nil
 }
 
 func VerifyImage(dfuImage dfufile.DFUImage, dfuDevice DFUDevice) (bool, error) {
+	err := dfuDevice.SelectAltSetting(int(dfuImage.Prefix.AltSetting))
+
+	if err != nil {
+		return false, err
+	}
+
+	if !dfuDevice.IsDfuSe() {
+		return verifyPlain(dfuImage, dfuDevice)
+	}
+
 	for _, target := range dfuImage.Targets {
 		deviceData, err := dfuDevice.ReadMemory(uint(target.Prefix.Address), uint(target.Prefix.Size), "Verifying Image")
 
@@ -0,0 +1,361 @@
+package dfudevice
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/willtoth/go-dfuse/dfufile"
+)
+
+func newTestSimulator(t *testing.T, descriptors ...string) *Simulator {
+	t.Helper()
+
+	sim, err := NewSimulator(descriptors...)
+
+	if err != nil {
+		t.Fatalf("NewSimulator() failed: %v", err)
+	}
+	return sim
+}
+
+func newTestImage(t *testing.T, alt uint8, address uint32, data []byte) dfufile.DFUImage {
+	t.Helper()
+
+	image, err := dfufile.ParseBinary(data, address, 0)
+
+	if err != nil {
+		t.Fatalf("ParseBinary() failed: %v", err)
+	}
+
+	image.Prefix.AltSetting = alt
+	return image
+}
+
+func testPattern(length int, seed byte) []byte {
+	data := make([]byte, length)
+	for idx := range data {
+		data[idx] = byte(idx)*13 + seed
+	}
+	return data
+}
+
+func TestWriteFileKeepsAltSetting(t *testing.T) {
+	sim := newTestSimulator(t, testFlash, testOptionBytes)
+	dev := sim.Device()
+
+	flash := testPattern(100, 1)
+	file := dfufile.DFUFile{Images: []dfufile.DFUImage{
+		newTestImage(t, 0, 0x08000000, flash),
+		newTestImage(t, 1, 0x1fffc000, []byte{0xaa, 0xd5}),
+	}}
+
+	_, err := WriteFileWithOptions(file, dev, WriteOptions{Erase: EraseModeNone})
+
+	if err != nil {
+		t.Fatalf("WriteFileWithOptions() failed: %v", err)
+	}
+
+	//dev is still on alt setting 0, the copy passed to WriteFile moved the
+	//interface to the option bytes
+	data, err := dev.ReadMemory(0x08000000, uint(len(flash)), "")
+
+	if err != nil {
+		t.Fatalf("ReadMemory() after a multi alt write failed: %v", err)
+	}
+
+	if !bytes.Equal(data, flash) {
+		t.Errorf("flash read back does not match")
+	}
+
+	err = dev.ExitDFU(0x08000000)
+
+	if err != nil {
+		t.Fatalf("ExitDFU() after a multi alt write failed: %v", err)
+	}
+
+	if !sim.Manifested || sim.JumpAddress != 0x08000000 {
+		t.Errorf("expected a jump to 0x8000000, got manifested %v at 0x%x", sim.Manifested, sim.JumpAddress)
+	}
+}
+
+func TestWriteImageNotErasable(t *testing.T) {
+	sim := newTestSimulator(t, testFlash, testOptionBytes)
+	dev := sim.Device()
+
+	optionBytes := []byte{0xaa, 0xd5, 0xff, 0x0f}
+	_, err := WriteImageWithOptions(newTestImage(t, 1, 0x1fffc000, optionBytes), dev, WriteOptions{})
+
+	if err != nil {
+		t.Fatalf("WriteImageWithOptions() on option bytes failed: %v", err)
+	}
+
+	if sim.Stats.PageErases != 0 {
+		t.Errorf("expected no page erases, got %d", sim.Stats.PageErases)
+	}
+
+	data, err := sim.Memory(1, 0x1fffc000, uint(len(optionBytes)))
+
+	if err != nil || !bytes.Equal(data, optionBytes) {
+		t.Errorf("expected option bytes % x, got % x (%v)", optionBytes, data, err)
+	}
+}
+
+func TestPlanErase(t *testing.T) {
+	flash, err := parseMemoryDescriptor(0, testFlash)
+
+	if err != nil {
+		t.Fatalf("parseMemoryDescriptor() failed: %v", err)
+	}
+
+	optionBytes, err := parseMemoryDescriptor(1, testOptionBytes)
+
+	if err != nil {
+		t.Fatalf("parseMemoryDescriptor() failed: %v", err)
+	}
+
+	type span struct {
+		addr   uint32
+		length int
+	}
+
+	tests := []struct {
+		name    string
+		region  MemoryRegion
+		targets []span
+		pages   []uint
+		errText string
+	}{
+		{
+			name:    "within one sector",
+			region:  flash,
+			targets: []span{{0x08004010, 0x100}},
+			pages:   []uint{0x08004000},
+		},
+		{
+			name:    "unaligned start into the 64K sector",
+			region:  flash,
+			targets: []span{{0x08002000, 0x10000}},
+			pages:   []uint{0x08000000, 0x08004000, 0x08008000, 0x0800c000, 0x08010000},
+		},
+		{
+			name:    "64K to 128K boundary",
+			region:  flash,
+			targets: []span{{0x0801fff0, 0x20}},
+			pages:   []uint{0x08010000, 0x08020000},
+		},
+		{
+			name:    "shared sectors erased once and sorted",
+			region:  flash,
+			targets: []span{{0x08040000, 0x10}, {0x08000000, 0x10}, {0x08000100, 0x4000}},
+			pages:   []uint{0x08000000, 0x08004000, 0x08040000},
+		},
+		{
+			name:    "not erasable",
+			region:  optionBytes,
+			targets: []span{{0x1fffc000, 0x10}},
+			pages:   []uint{},
+		},
+		{
+			name:    "outside of the memory map",
+			region:  flash,
+			targets: []span{{0x080ffff0, 0x20}},
+			errText: "outside of the memory map",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			targets := make([]dfufile.DFUTarget, len(test.targets))
+			for idx, target := range test.targets {
+				targets[idx].Prefix.Address = target.addr
+				targets[idx].Prefix.Size = uint32(target.length)
+				targets[idx].Elements = make([]byte, target.length)
+			}
+
+			pages, err := planErase(test.region, targets)
+
+			if test.errText != "" {
+				if err == nil || !strings.Contains(err.Error(), test.errText) {
+					t.Fatalf("expected an error containing %q, got %v", test.errText, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(pages, test.pages) {
+				t.Errorf("expected pages %x, got %x", test.pages, pages)
+			}
+		})
+	}
+}
+
+func TestWriteFileMassErase(t *testing.T) {
+	flash := newTestImage(t, 0, 0x08000000, testPattern(0x100, 1))
+	flashEnd := newTestImage(t, 0, 0x080e0000, testPattern(0x100, 2))
+	optionBytes := newTestImage(t, 1, 0x1fffc000, []byte{0xaa, 0xd5})
+	external := newTestImage(t, 2, 0x90000000, testPattern(0x100, 3))
+
+	tests := []struct {
+		name       string
+		images     []dfufile.DFUImage
+		massErases int
+	}{
+		{"flash and option bytes", []dfufile.DFUImage{flash, optionBytes, flashEnd}, 1},
+		{"option bytes first", []dfufile.DFUImage{optionBytes, flash}, 1},
+		{"option bytes only", []dfufile.DFUImage{optionBytes}, 0},
+		{"internal and external flash", []dfufile.DFUImage{flash, external, flashEnd}, 2},
+		{"external flash only", []dfufile.DFUImage{external}, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sim := newTestSimulator(t, testFlash, testOptionBytes, testExternalFlash)
+
+			//Programmed flash has to be erased for the write to succeed
+			err := sim.Load(0, 0x08000000, make([]byte, 0x100))
+
+			if err == nil {
+				err = sim.Load(2, 0x90000000, make([]byte, 0x100))
+			}
+
+			if err != nil {
+				t.Fatalf("Load() failed: %v", err)
+			}
+
+			file := dfufile.DFUFile{Images: test.images}
+			_, err = WriteFileWithOptions(file, sim.Device(), WriteOptions{Erase: EraseModeMass})
+
+			if err != nil {
+				t.Fatalf("WriteFileWithOptions() failed: %v", err)
+			}
+
+			if sim.Stats.MassErases != test.massErases {
+				t.Errorf("expected %d mass erases, got %d", test.massErases, sim.Stats.MassErases)
+			}
+
+			ok, err := VerifyFile(file, sim.Device())
+
+			if err != nil || !ok {
+				t.Errorf("VerifyFile() after a mass erase returned %v, %v", ok, err)
+			}
+		})
+	}
+}
+
+func TestWriteFileBoundsBeforeErase(t *testing.T) {
+	flash := newTestImage(t, 0, 0x08000000, testPattern(0x100, 1))
+	outside := newTestImage(t, 0, 0x09000000, testPattern(0x100, 2))
+	optionBytes := newTestImage(t, 1, 0x1fffc000, []byte{0xaa, 0xd5})
+
+	//Fits in flash but not in the option bytes of its own alt setting
+	wrongAlt := newTestImage(t, 1, 0x08000000, []byte{1, 2})
+
+	tests := []struct {
+		name   string
+		images []dfufile.DFUImage
+		erase  EraseMode
+	}{
+		{"mass erase", []dfufile.DFUImage{flash, outside}, EraseModeMass},
+		{"page erase", []dfufile.DFUImage{flash, outside}, EraseModePages},
+		{"later alt setting", []dfufile.DFUImage{flash, optionBytes, wrongAlt}, EraseModeMass},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sim := newTestSimulator(t, testFlash, testOptionBytes)
+			programmed := testPattern(0x100, 9)
+
+			err := sim.Load(0, 0x08000000, programmed)
+
+			if err != nil {
+				t.Fatalf("Load() failed: %v", err)
+			}
+
+			file := dfufile.DFUFile{Images: test.images}
+			results, err := WriteFileWithOptions(file, sim.Device(), WriteOptions{Erase: test.erase})
+
+			var boundsErr *BoundsError
+			if !errors.As(err, &boundsErr) {
+				t.Fatalf("expected a BoundsError, got %v", err)
+			}
+
+			if len(results) != 0 {
+				t.Errorf("expected no image attempted, got %d results", len(results))
+			}
+
+			if sim.Stats.MassErases != 0 || sim.Stats.PageErases != 0 || sim.Stats.Writes != 0 {
+				t.Errorf("expected the device untouched, got %+v", sim.Stats)
+			}
+
+			data, err := sim.Memory(0, 0x08000000, uint(len(programmed)))
+
+			if err != nil || !bytes.Equal(data, programmed) {
+				t.Errorf("flash changed before the bounds error (%v)", err)
+			}
+		})
+	}
+}
+
+func TestWriteDifferential(t *testing.T) {
+	const start, length = 0x08002000, 0x10000
+
+	tests := []struct {
+		name       string
+		changes    []uint
+		pageErases int
+		written    uint
+	}{
+		{name: "unchanged", changes: nil, pageErases: 0, written: 0},
+		{name: "one 16K sector", changes: []uint{0x08005000}, pageErases: 1, written: 0x4000},
+		{name: "partial first and last sectors", changes: []uint{0x08002000, 0x08011fff}, pageErases: 2, written: 0x4000},
+		{name: "same sector twice", changes: []uint{0x0800c000, 0x0800ffff}, pageErases: 1, written: 0x4000},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sim := newTestSimulator(t, testFlash)
+			dev := sim.Device()
+
+			data := testPattern(length, 3)
+			_, err := WriteImageWithOptions(newTestImage(t, 0, start, data), dev, WriteOptions{})
+
+			if err != nil {
+				t.Fatalf("initial write failed: %v", err)
+			}
+
+			for _, addr := range test.changes {
+				data[addr-start] ^= 0xff
+			}
+
+			sim.Stats = SimStats{}
+			image := newTestImage(t, 0, start, data)
+			result, err := WriteImageWithOptions(image, dev, WriteOptions{Differential: true})
+
+			if err != nil {
+				t.Fatalf("differential write failed: %v", err)
+			}
+
+			if sim.Stats.PageErases != test.pageErases {
+				t.Errorf("expected %d page erases, got %d", test.pageErases, sim.Stats.PageErases)
+			}
+
+			target := result.Targets[0]
+			if target.BytesWritten != test.written || target.BytesSkipped != length-test.written || !target.Done() {
+				t.Errorf("expected 0x%x bytes written and 0x%x skipped, got 0x%x and 0x%x",
+					test.written, length-test.written, target.BytesWritten, target.BytesSkipped)
+			}
+
+			ok, err := VerifyImage(image, dev)
+
+			if err != nil || !ok {
+				t.Errorf("VerifyImage() after a differential write returned %v, %v", ok, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,645 @@
+package dfudevice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// SimOperation identifies the device side operation a fault is injected into
+type SimOperation int
+
+const (
+	SimSetAddress SimOperation = iota
+	SimErase
+	SimMassErase
+	SimReadUnprotect
+	SimWrite
+	SimRead
+	SimLeave
+)
+
+// SimFault is returned by a Simulator.Fault hook. Err fails the control
+// transfer itself, Status (a DFU bStatus code such as 0x08 errADDRESS) puts
+// the device in dfuERROR when the operation executes.
+type SimFault struct {
+	Err    error
+	Status uint8
+}
+
+// SimStats counts the operations a Simulator has executed
+type SimStats struct {
+	SetAddress   int
+	PageErases   int
+	MassErases   int
+	Writes       int
+	BytesWritten int
+	Reads        int
+	BytesRead    int
+	StatusPolls  int
+}
+
+type simSegment struct {
+	layout MemoryLayout
+	data   []byte
+}
+
+// Simulator is an in-memory STM32 DfuSe bootloader (AN3156). It implements
+// the DFU state machine, bwPollTimeout, the set-address, erase and
+// read-unprotect commands and flash like programming, where writing can only
+// clear bits of erased memory. With DFUVersion set to 0x0110 it behaves as a
+// plain DFU 1.1 device instead.
+type Simulator struct {
+	mu sync.Mutex
+
+	//PollTimeout is reported as bwPollTimeout (ms), GetStatus sleeps for it
+	PollTimeout uint
+	//TransferSize is the wTransferSize used to compute block addresses
+	TransferSize uint
+	//BusyPolls is the number of extra dfuDNBUSY states reported per command
+	BusyPolls int
+	//ReadProtected makes uploads fail with errVENDOR until ReadUnprotect
+	ReadProtected bool
+	//DFUVersion is reported as bcdDFUVersion. Anything but 0x011a makes a
+	//plain DFU device, which transfers the memory of the selected alternate
+	//setting sequentially from its first address, erasing it on block 0
+	DFUVersion uint16
+	//Attributes is reported as bmAttributes of the functional descriptor
+	Attributes uint8
+	//Fault is called before every operation executes, nil means no faults
+	Fault func(op SimOperation, addr uint) SimFault
+
+	//Stats counts executed operations
+	Stats SimStats
+	//Manifested is set once the device left DFU mode, JumpAddress holds
+	//the address pointer at that time
+	Manifested  bool
+	JumpAddress uint
+
+	descriptors []string
+	segments    [][]simSegment
+
+	alt      int
+	state    uint8
+	status   uint8
+	busy     int
+	pending  func() uint8
+	failed   uint8
+	address  uint
+	detached bool
+}
+
+// NewSimulator creates a device with one alternate setting per memory
+// descriptor, e.g. "@Internal Flash  /0x08000000/04*016Kg,01*064Kg,07*128Kg".
+// All memory starts erased (0xff).
+func NewSimulator(descriptors ...string) (*Simulator, error) {
+	s := &Simulator{
+		TransferSize: 2048,
+		DFUVersion:   dfuVersionDfuSe,
+		Attributes:   dfuAttrCanDnload | dfuAttrCanUpload | dfuAttrWillDetach,
+		descriptors:  descriptors,
+		state:        dfuStateDfuIdle,
+		status:       dfuStatusOk,
+	}
+
+	for alt, desc := range descriptors {
+		region, err := parseMemoryDescriptor(alt, desc)
+		if err != nil {
+			return nil, err
+		}
+
+		segments := make([]simSegment, len(region.Segments))
+		for idx, layout := range region.Segments {
+			segments[idx] = simSegment{layout, bytes.Repeat([]byte{0xff}, int(layout.Size))}
+		}
+
+		s.segments = append(s.segments, segments)
+	}
+
+	return s, nil
+}
+
+// Device returns a DFUDevice backed by the simulator
+func (s *Simulator) Device() DFUDevice {
+	device := DFUDevice{dev: s, cfgNum: dfuCONFIG, intfNum: dfuINTERFACE}
+	device.trackAltSetting()
+
+	//Only fails when TransferSize is 0, the device is then left without
+	//attributes and refuses every download
+	device.loadFunctionalDescriptor()
+	return device
+}
+
+// State returns the current DFU state (bState) of the device
+func (s *Simulator) State() uint8 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// Load fills simulated memory of alternate setting alt, ignoring permissions
+func (s *Simulator) Load(alt int, addr uint, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(data) > 0 {
+		segment, offset, ok := s.find(alt, addr)
+		if !ok {
+			return fmt.Errorf("Address 0x%x is not in alt setting %d", addr, alt)
+		}
+
+		n := copy(segment.data[offset:], data)
+		addr += uint(n)
+		data = data[n:]
+	}
+	return nil
+}
+
+// Memory returns a copy of simulated memory of alternate setting alt
+func (s *Simulator) Memory(alt int, addr, length uint) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data := make([]byte, 0, length)
+
+	for uint(len(data)) < length {
+		segment, offset, ok := s.find(alt, addr)
+		if !ok {
+			return data, fmt.Errorf("Address 0x%x is not in alt setting %d", addr, alt)
+		}
+
+		chunk := segment.data[offset:]
+		if uint(len(chunk)) > length-uint(len(data)) {
+			chunk = chunk[:length-uint(len(data))]
+		}
+
+		data = append(data, chunk...)
+		addr += uint(len(chunk))
+	}
+	return data, nil
+}
+
+func (s *Simulator) find(alt int, addr uint) (*simSegment, uint, bool) {
+	if alt < 0 || alt >= len(s.segments) {
+		return nil, 0, false
+	}
+
+	for idx := range s.segments[alt] {
+		segment := &s.segments[alt][idx]
+		if segment.layout.Contains(addr) {
+			return segment, addr - segment.layout.StartAddress, true
+		}
+	}
+	return nil, 0, false
+}
+
+func (s *Simulator) fault(op SimOperation, addr uint) SimFault {
+	if s.Fault == nil {
+		return SimFault{}
+	}
+	return s.Fault(op, addr)
+}
+
+func (s *Simulator) setError(status uint8) {
+	s.state = dfuStateDfuError
+	s.status = status
+}
+
+func (s *Simulator) List(filter DeviceFilter) []string {
+	return nil
+}
+
+func (s *Simulator) Open(path string) (DFUDevice, error) {
+	return DFUDevice{}, fmt.Errorf("Simulator is opened with Simulator.Device()")
+}
+
+func (s *Simulator) ListRuntime(filter DeviceFilter) []string {
+	return nil
+}
+
+func (s *Simulator) Enumerate(filter DeviceFilter) ([]DeviceInfo, error) {
+	return nil, nil
+}
+
+func (s *Simulator) OpenRuntime(path string) (DFUDevice, error) {
+	return DFUDevice{}, fmt.Errorf("Simulator has no runtime mode")
+}
+
+// Reset simulates a USB reset, the device leaves DFU mode and stops answering
+func (s *Simulator) Reset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.detached = true
+	return nil
+}
+
+func (s *Simulator) Close() {
+}
+
+func (s *Simulator) InterfaceDescription(cfgNum, intfNum, altNum int) (string, error) {
+	if intfNum != dfuINTERFACE || altNum < 0 || altNum >= len(s.descriptors) {
+		return "", fmt.Errorf("No interface %d alt setting %d", intfNum, altNum)
+	}
+	return s.descriptors[altNum], nil
+}
+
+func (s *Simulator) FunctionalDescriptor(cfgNum, intfNum int) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if intfNum != dfuINTERFACE {
+		return nil, fmt.Errorf("No interface %d", intfNum)
+	}
+
+	desc := FunctionalDescriptor{
+		Attributes:    s.Attributes,
+		DetachTimeout: 255,
+		TransferSize:  uint16(s.TransferSize),
+		DFUVersion:    s.DFUVersion,
+	}
+	return desc.bytes(), nil
+}
+
+func (s *Simulator) SetAltSetting(intfNum, altNum int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if intfNum != dfuINTERFACE || altNum < 0 || altNum >= len(s.descriptors) {
+		return fmt.Errorf("No interface %d alt setting %d", intfNum, altNum)
+	}
+
+	s.alt = altNum
+
+	//Only a USB reset gets a device out of dfuMANIFEST-WAIT-RESET
+	if s.state != dfuStateDfuManifestWaitReset {
+		s.state = dfuStateDfuIdle
+		s.status = dfuStatusOk
+	}
+	return nil
+}
+
+func (s *Simulator) Control(rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.detached {
+		return 0, errNoDevice
+	}
+
+	if idx != dfuINTERFACE {
+		return 0, fmt.Errorf("Simulated device has no interface %d", idx)
+	}
+
+	switch request {
+	case cmdGETSTATUS:
+		return s.getStatus(data)
+	case cmdGETSTATE:
+		if len(data) < 1 {
+			return 0, fmt.Errorf("GETSTATE buffer too short")
+		}
+		data[0] = s.state
+		return 1, nil
+	case cmdCLRSTATUS, cmdABORT:
+		//The ST bootloader returns to dfuIDLE from any state
+		s.state = dfuStateDfuIdle
+		s.status = dfuStatusOk
+		s.pending = nil
+		s.failed = dfuStatusOk
+		return 0, nil
+	case cmdDNLOAD:
+		return s.dnload(val, data)
+	case cmdUPLOAD:
+		return s.upload(val, data)
+	}
+
+	s.setError(dfuStatusErrorStalledPkt)
+	return 0, fmt.Errorf("Simulated device stalled request 0x%02x", request)
+}
+
+func (s *Simulator) getStatus(data []byte) (int, error) {
+	if len(data) < 6 {
+		return 0, fmt.Errorf("GETSTATUS buffer too short")
+	}
+
+	s.Stats.StatusPolls++
+
+	switch s.state {
+	case dfuStateDfuDownloadSync:
+		//The command executes on the first status request after it was
+		//sent, a failure shows up on the following one as on hardware
+		s.state = dfuStateDfuDownloadBusy
+		s.busy = s.BusyPolls
+		s.failed = s.pending()
+		s.pending = nil
+	case dfuStateDfuDownloadBusy:
+		if s.failed != dfuStatusOk {
+			s.setError(s.failed)
+			s.failed = dfuStatusOk
+		} else if s.busy > 0 {
+			s.busy--
+		} else {
+			s.state = dfuStateDfuDownloadIdle
+		}
+	case dfuStateDfuManifestSync:
+		s.state = dfuStateDfuManifest
+		s.Manifested = true
+		s.JumpAddress = s.address
+	case dfuStateDfuManifest:
+		if s.DFUVersion == dfuVersionDfuSe {
+			s.detached = true
+		} else if s.Attributes&dfuAttrManifestationTolerant != 0 {
+			s.state = dfuStateDfuIdle
+		} else {
+			s.state = dfuStateDfuManifestWaitReset
+		}
+	}
+
+	data[0] = s.status
+	data[1] = byte(s.PollTimeout)
+	data[2] = byte(s.PollTimeout >> 8)
+	data[3] = byte(s.PollTimeout >> 16)
+	data[4] = s.state
+	data[5] = 0
+
+	return 6, nil
+}
+
+func (s *Simulator) dnload(block uint16, data []byte) (int, error) {
+	if s.state != dfuStateDfuIdle && s.state != dfuStateDfuDownloadIdle {
+		s.setError(dfuStatusErrorStalledPkt)
+		return 0, fmt.Errorf("Simulated device stalled DNLOAD in state %d", s.state)
+	}
+
+	if len(data) == 0 {
+		//Leave DFU mode, jumping to the address pointer
+		if fault := s.fault(SimLeave, s.address); fault.Err != nil {
+			return 0, fault.Err
+		} else if fault.Status != dfuStatusOk {
+			s.setError(fault.Status)
+			return 0, nil
+		}
+		s.state = dfuStateDfuManifestSync
+		return 0, nil
+	}
+
+	var op SimOperation
+	var addr uint
+	var execute func() uint8
+
+	switch {
+	case s.DFUVersion != dfuVersionDfuSe:
+		op = SimWrite
+		addr = s.plainAddress(block)
+		erase := s.state == dfuStateDfuIdle
+		payload := append([]byte(nil), data...)
+		execute = func() uint8 {
+			if erase {
+				if status := s.massErase(); status != dfuStatusOk {
+					return status
+				}
+			}
+			return s.write(addr, payload)
+		}
+	case block == 0 && data[0] == dnloadCmdSetAddress && len(data) == 5:
+		op = SimSetAddress
+		addr = uint(binary.LittleEndian.Uint32(data[1:]))
+		execute = func() uint8 { return s.setAddress(addr) }
+	case block == 0 && data[0] == dnloadCmdErase && len(data) == 5:
+		op = SimErase
+		addr = uint(binary.LittleEndian.Uint32(data[1:]))
+		execute = func() uint8 { return s.pageErase(addr) }
+	case block == 0 && data[0] == dnloadCmdErase && len(data) == 1:
+		op = SimMassErase
+		execute = s.massErase
+	case block == 0 && data[0] == dnloadCmdReadUnprotect && len(data) == 1:
+		op = SimReadUnprotect
+		execute = s.readUnprotect
+	case block >= 2:
+		op = SimWrite
+		addr = s.address + uint(block-2)*s.TransferSize
+		payload := append([]byte(nil), data...)
+		execute = func() uint8 { return s.write(addr, payload) }
+	default:
+		s.setError(dfuStatusErrorStalledPkt)
+		return 0, fmt.Errorf("Simulated device stalled unknown DNLOAD command")
+	}
+
+	fault := s.fault(op, addr)
+	if fault.Err != nil {
+		return 0, fault.Err
+	}
+
+	if fault.Status != dfuStatusOk {
+		status := fault.Status
+		execute = func() uint8 { return status }
+	}
+
+	s.pending = execute
+	s.state = dfuStateDfuDownloadSync
+
+	return len(data), nil
+}
+
+func (s *Simulator) setAddress(addr uint) uint8 {
+	s.Stats.SetAddress++
+
+	if _, _, ok := s.find(s.alt, addr); !ok {
+		return dfuStatusErrorTarget
+	}
+
+	s.address = addr
+	return dfuStatusOk
+}
+
+func (s *Simulator) pageErase(addr uint) uint8 {
+	s.Stats.PageErases++
+
+	segment, offset, ok := s.find(s.alt, addr)
+	if !ok || !segment.layout.Erasable {
+		return dfuStatusErrorTarget
+	}
+
+	if s.ReadProtected {
+		return dfuStatusErrorVendor
+	}
+
+	page := offset / segment.layout.PageSize * segment.layout.PageSize
+	for idx := page; idx < page+segment.layout.PageSize; idx++ {
+		segment.data[idx] = 0xff
+	}
+	return dfuStatusOk
+}
+
+func (s *Simulator) massErase() uint8 {
+	s.Stats.MassErases++
+
+	if s.ReadProtected {
+		return dfuStatusErrorVendor
+	}
+
+	for idx := range s.segments[s.alt] {
+		segment := &s.segments[s.alt][idx]
+		if segment.layout.Erasable {
+			for i := range segment.data {
+				segment.data[i] = 0xff
+			}
+		}
+	}
+	return dfuStatusOk
+}
+
+func (s *Simulator) readUnprotect() uint8 {
+	for alt := range s.segments {
+		for idx := range s.segments[alt] {
+			segment := &s.segments[alt][idx]
+			if segment.layout.Erasable {
+				for i := range segment.data {
+					segment.data[i] = 0xff
+				}
+			}
+		}
+	}
+
+	//The device resets once the status of the command has been reported
+	s.ReadProtected = false
+	s.detached = true
+	return dfuStatusOk
+}
+
+func (s *Simulator) write(addr uint, data []byte) uint8 {
+	s.Stats.Writes++
+
+	if s.ReadProtected {
+		return dfuStatusErrorVendor
+	}
+
+	for len(data) > 0 {
+		segment, offset, ok := s.find(s.alt, addr)
+		if !ok {
+			return dfuStatusErrorAddress
+		}
+		if !segment.layout.Writeable {
+			return dfuStatusErrorWrite
+		}
+
+		chunk := data
+		if uint(len(chunk)) > segment.layout.Size-offset {
+			chunk = chunk[:segment.layout.Size-offset]
+		}
+
+		for idx, b := range chunk {
+			if segment.layout.Erasable {
+				//Flash can only clear bits
+				segment.data[offset+uint(idx)] &= b
+			} else {
+				segment.data[offset+uint(idx)] = b
+			}
+		}
+
+		s.Stats.BytesWritten += len(chunk)
+		addr += uint(len(chunk))
+		data = data[len(chunk):]
+	}
+	return dfuStatusOk
+}
+
+func (s *Simulator) upload(block uint16, data []byte) (int, error) {
+	if s.state != dfuStateDfuIdle && s.state != dfuStateDfuUploadIdle {
+		s.setError(dfuStatusErrorStalledPkt)
+		return 0, fmt.Errorf("Simulated device stalled UPLOAD in state %d", s.state)
+	}
+
+	if s.DFUVersion != dfuVersionDfuSe {
+		return s.plainUpload(block, data)
+	}
+
+	if block == 0 {
+		//Get command, lists the supported special commands
+		n := copy(data, []byte{0x00, dnloadCmdSetAddress, dnloadCmdErase, dnloadCmdReadUnprotect})
+		s.state = dfuStateDfuUploadIdle
+		return n, nil
+	}
+
+	if block < 2 {
+		s.setError(dfuStatusErrorStalledPkt)
+		return 0, fmt.Errorf("Simulated device stalled UPLOAD block %d", block)
+	}
+
+	addr := s.address + uint(block-2)*s.TransferSize
+
+	fault := s.fault(SimRead, addr)
+	if fault.Err != nil {
+		return 0, fault.Err
+	}
+	if fault.Status != dfuStatusOk {
+		s.setError(fault.Status)
+		return 0, fmt.Errorf("Simulated device stalled UPLOAD at 0x%x", addr)
+	}
+
+	if s.ReadProtected {
+		s.setError(dfuStatusErrorVendor)
+		return 0, fmt.Errorf("Simulated device is read protected")
+	}
+
+	s.Stats.Reads++
+
+	read := 0
+	for read < len(data) {
+		segment, offset, ok := s.find(s.alt, addr+uint(read))
+		if !ok || !segment.layout.Readable {
+			s.setError(dfuStatusErrorTarget)
+			return read, fmt.Errorf("Simulated device stalled UPLOAD at 0x%x", addr+uint(read))
+		}
+		read += copy(data[read:], segment.data[offset:])
+	}
+
+	s.Stats.BytesRead += read
+	s.state = dfuStateDfuUploadIdle
+	return read, nil
+}
+
+// plainAddress is where block lands on a plain DFU device, blocks are
+// numbered from the first address of the selected alternate setting
+func (s *Simulator) plainAddress(block uint16) uint {
+	return s.segments[s.alt][0].layout.StartAddress + uint(block)*s.TransferSize
+}
+
+func (s *Simulator) plainUpload(block uint16, data []byte) (int, error) {
+	addr := s.plainAddress(block)
+
+	fault := s.fault(SimRead, addr)
+	if fault.Err != nil {
+		return 0, fault.Err
+	}
+	if fault.Status != dfuStatusOk {
+		s.setError(fault.Status)
+		return 0, fmt.Errorf("Simulated device stalled UPLOAD at 0x%x", addr)
+	}
+
+	if s.ReadProtected {
+		s.setError(dfuStatusErrorVendor)
+		return 0, fmt.Errorf("Simulated device is read protected")
+	}
+
+	s.Stats.Reads++
+
+	//The end of memory is signalled with a short packet
+	read := 0
+	for read < len(data) {
+		segment, offset, ok := s.find(s.alt, addr+uint(read))
+		if !ok || !segment.layout.Readable {
+			break
+		}
+		read += copy(data[read:], segment.data[offset:])
+	}
+
+	s.Stats.BytesRead += read
+	if read < len(data) {
+		s.state = dfuStateDfuIdle
+	} else {
+		s.state = dfuStateDfuUploadIdle
+	}
+	return read, nil
+}
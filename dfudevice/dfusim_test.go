@@ -0,0 +1,247 @@
+package dfudevice
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/willtoth/go-dfuse/dfufile"
+)
+
+func TestSimulatorMixedSectors(t *testing.T) {
+	const start, length = 0x08002001, 0x30000
+
+	sim := newTestSimulator(t, testFlash)
+	sim.BusyPolls = 1
+	dev := sim.Device()
+
+	//Everything programmed, erased sectors show up as 0xff
+	for addr := uint(0x08000000); addr < 0x08100000; addr += 0x10000 {
+		err := sim.Load(0, addr, make([]byte, 0x10000))
+
+		if err != nil {
+			t.Fatalf("Load() failed: %v", err)
+		}
+	}
+
+	data := testPattern(length, 5)
+	image := newTestImage(t, 0, start, data)
+	result, err := WriteImageWithOptions(image, dev, WriteOptions{})
+
+	if err != nil {
+		t.Fatalf("WriteImageWithOptions() failed: %v", err)
+	}
+
+	if !result.Targets[0].Done() {
+		t.Errorf("target not done: %+v", result.Targets[0])
+	}
+
+	//Four 16K, the 64K and the first 128K sector
+	if sim.Stats.PageErases != 6 {
+		t.Errorf("expected 6 page erases, got %d", sim.Stats.PageErases)
+	}
+
+	tests := []struct {
+		name     string
+		addr     uint
+		expected []byte
+	}{
+		{"image", start, data},
+		{"erased before the image", 0x08000000, bytes.Repeat([]byte{0xff}, start-0x08000000)},
+		{"erased after the image", start + length, bytes.Repeat([]byte{0xff}, 0x08040000-(start+length))},
+		{"next sector untouched", 0x08040000, make([]byte, 0x100)},
+	}
+
+	for _, test := range tests {
+		memory, err := sim.Memory(0, test.addr, uint(len(test.expected)))
+
+		if err != nil {
+			t.Fatalf("%s: Memory() failed: %v", test.name, err)
+		}
+
+		if !bytes.Equal(memory, test.expected) {
+			t.Errorf("%s: memory at 0x%x does not match", test.name, test.addr)
+		}
+	}
+
+	ok, err := VerifyImage(image, dev)
+
+	if err != nil || !ok {
+		t.Errorf("VerifyImage() returned %v, %v", ok, err)
+	}
+}
+
+func TestSimulatorVerifyMismatch(t *testing.T) {
+	sim := newTestSimulator(t, testFlash)
+	dev := sim.Device()
+
+	image := newTestImage(t, 0, 0x08004000, testPattern(0x1000, 7))
+
+	ok, err := VerifyImage(image, dev)
+
+	if err != nil || ok {
+		t.Fatalf("expected blank memory to fail verification, got %v, %v", ok, err)
+	}
+
+	_, err = WriteImageWithOptions(image, dev, WriteOptions{})
+
+	if err != nil {
+		t.Fatalf("WriteImageWithOptions() failed: %v", err)
+	}
+
+	err = sim.Load(0, 0x08004fff, []byte{0})
+
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+
+	ok, err = VerifyImage(image, dev)
+
+	if err != nil || ok {
+		t.Errorf("expected a changed last byte to fail verification, got %v, %v", ok, err)
+	}
+}
+
+func TestSimulatorFaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		fault  func(op SimOperation, addr uint) SimFault
+		done   int
+		failed int
+	}{
+		{
+			name: "program error",
+			fault: func(op SimOperation, addr uint) SimFault {
+				if op == SimWrite && addr == 0x08000800 {
+					return SimFault{Status: dfuStatusErrorProg}
+				}
+				return SimFault{}
+			},
+			done:   1,
+			failed: 1,
+		},
+		{
+			name: "transfer error",
+			fault: func(op SimOperation, addr uint) SimFault {
+				if op == SimWrite && addr == 0x08001000 {
+					return SimFault{Err: fmt.Errorf("pipe error")}
+				}
+				return SimFault{}
+			},
+			done:   2,
+			failed: 2,
+		},
+		{
+			name: "bad address",
+			fault: func(op SimOperation, addr uint) SimFault {
+				if op == SimSetAddress && addr == 0x08000000 {
+					return SimFault{Status: dfuStatusErrorTarget}
+				}
+				return SimFault{}
+			},
+			done:   0,
+			failed: 0,
+		},
+		{
+			name: "erase error",
+			fault: func(op SimOperation, addr uint) SimFault {
+				if op == SimErase {
+					return SimFault{Status: dfuStatusErrorErase}
+				}
+				return SimFault{}
+			},
+			done:   0,
+			failed: -1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sim := newTestSimulator(t, testFlash)
+			sim.Fault = test.fault
+			dev := sim.Device()
+
+			//Three targets of one transfer each
+			image, err := dfufile.ParseBinary(testPattern(0x1800, 9), 0x08000000, 0x800)
+
+			if err != nil {
+				t.Fatalf("ParseBinary() failed: %v", err)
+			}
+
+			result, err := WriteImageWithOptions(image, dev, WriteOptions{})
+
+			if err == nil {
+				t.Fatalf("expected the fault to fail the write")
+			}
+
+			for idx, target := range result.Targets {
+				switch {
+				case idx < test.done:
+					if !target.Done() {
+						t.Errorf("target %d: expected done, got %+v", idx, target)
+					}
+				case idx == test.failed:
+					if target.Err == nil || target.BytesWritten != 0 {
+						t.Errorf("target %d: expected the error, got %+v", idx, target)
+					}
+				default:
+					if target.Err != nil || target.BytesWritten != 0 {
+						t.Errorf("target %d: expected untouched, got %+v", idx, target)
+					}
+				}
+			}
+
+			//The device is usable again once the fault is gone
+			sim.Fault = nil
+			_, err = WriteImageWithOptions(image, dev, WriteOptions{})
+
+			if err != nil {
+				t.Errorf("write after the fault failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestSimulatorExitDFU(t *testing.T) {
+	tests := []struct {
+		name       string
+		addr       uint
+		fault      func(op SimOperation, addr uint) SimFault
+		manifested bool
+	}{
+		{name: "start of flash", addr: 0x08000000, manifested: true},
+		{name: "application after a bootloader", addr: 0x08004000, manifested: true},
+		{name: "outside of memory", addr: 0x09000000},
+		{
+			name: "leave refused",
+			addr: 0x08000000,
+			fault: func(op SimOperation, addr uint) SimFault {
+				if op == SimLeave {
+					return SimFault{Status: dfuStatusErrorVendor}
+				}
+				return SimFault{}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sim := newTestSimulator(t, testFlash)
+			sim.Fault = test.fault
+
+			err := sim.Device().ExitDFU(test.addr)
+
+			if test.manifested != (err == nil) {
+				t.Fatalf("expected success %v, got %v", test.manifested, err)
+			}
+
+			if sim.Manifested != test.manifested {
+				t.Fatalf("expected manifested %v, got %v", test.manifested, sim.Manifested)
+			}
+
+			if test.manifested && sim.JumpAddress != test.addr {
+				t.Errorf("expected a jump to 0x%x, got 0x%x", test.addr, sim.JumpAddress)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+//go:build linux
+// +build linux
+
+package dfudevice
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const sysfsUSBDevices = "/sys/bus/usb/devices"
+
+func readSysfs(dir, attr string) string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, attr))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// sysfsHasDFU checks the interfaces of the active configuration of the sysfs
+// device dir for a DFU interface using protocol
+func sysfsHasDFU(dir, name string, protocol uint8) bool {
+	intfDirs, _ := filepath.Glob(filepath.Join(dir, name+":*"))
+
+	for _, intfDir := range intfDirs {
+		if readSysfs(intfDir, "bInterfaceClass") == fmt.Sprintf("%02x", usbClassApplication) &&
+			readSysfs(intfDir, "bInterfaceSubClass") == fmt.Sprintf("%02x", usbSubClassDFU) &&
+			readSysfs(intfDir, "bInterfaceProtocol") == fmt.Sprintf("%02x", protocol) {
+			return true
+		}
+	}
+	return false
+}
+
+// sysfsEnumerate lists every USB device matching filter. Paths are sysfs
+// device names such as "1-2.3", the bus and port chain of the device, which
+// both the usbfs and the libusb driver use.
+func sysfsEnumerate(filter DeviceFilter) []DeviceInfo {
+	devices := make([]DeviceInfo, 0)
+
+	entries, err := ioutil.ReadDir(sysfsUSBDevices)
+	if err != nil {
+		return devices
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		//Skip root hubs (usbN) and interfaces (1-2:1.0)
+		if strings.HasPrefix(name, "usb") || strings.Contains(name, ":") {
+			continue
+		}
+
+		dir := filepath.Join(sysfsUSBDevices, name)
+		vid, err := strconv.ParseUint(readSysfs(dir, "idVendor"), 16, 16)
+		if err != nil {
+			continue
+		}
+		pid, err := strconv.ParseUint(readSysfs(dir, "idProduct"), 16, 16)
+		if err != nil {
+			continue
+		}
+
+		if !filter.matches(uint16(vid), uint16(pid)) {
+			continue
+		}
+
+		info := DeviceInfo{
+			Path:   name,
+			VID:    uint16(vid),
+			PID:    uint16(pid),
+			Serial: readSysfs(dir, "serial"),
+			Mode:   DeviceModeApplication,
+		}
+		info.Address, _ = strconv.Atoi(readSysfs(dir, "devnum"))
+
+		if sysfsHasDFU(dir, name, usbProtocolDFU) {
+			info.Mode = DeviceModeDFU
+		} else if sysfsHasDFU(dir, name, usbProtocolRuntime) {
+			info.Mode = DeviceModeRuntime
+		}
+
+		devices = append(devices, info)
+	}
+
+	return devices
+}
@@ -0,0 +1,49 @@
+package dfufile
+
+import (
+	"fmt"
+	"io/ioutil"
+)
+
+// ReadBinary loads a raw binary file into a DFUImage starting at address,
+// see ParseBinary
+func ReadBinary(filename string, address uint32, maxElementSize uint) (DFUImage, error) {
+	data, err := ioutil.ReadFile(filename)
+
+	if err != nil {
+		return DFUImage{}, err
+	}
+
+	return ParseBinary(data, address, maxElementSize)
+}
+
+// ParseBinary wraps data in a DFUImage starting at address. When
+// maxElementSize is non zero the data is split into consecutive DFUTargets of
+// at most that many bytes.
+func ParseBinary(data []byte, address uint32, maxElementSize uint) (DFUImage, error) {
+	if len(data) == 0 {
+		return DFUImage{}, fmt.Errorf("Binary image is empty")
+	}
+
+	if uint64(address)+uint64(len(data)) > 1<<32 {
+		return DFUImage{}, fmt.Errorf("Binary image of %d bytes at 0x%x exceeds the 32 bit address space", len(data), address)
+	}
+
+	elementSize := uint(len(data))
+	if maxElementSize != 0 && maxElementSize < elementSize {
+		elementSize = maxElementSize
+	}
+
+	segments := make([]memorySegment, 0, (uint(len(data))+elementSize-1)/elementSize)
+
+	for offset := uint(0); offset < uint(len(data)); offset += elementSize {
+		end := offset + elementSize
+		if end > uint(len(data)) {
+			end = uint(len(data))
+		}
+
+		segments = append(segments, memorySegment{address + uint32(offset), data[offset:end]})
+	}
+
+	return newImage(segments), nil
+}
@@ -0,0 +1,98 @@
+package dfufile
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseBinary(t *testing.T) {
+	data := []byte{1, 2, 3, 4, 5, 6, 7}
+
+	tests := []struct {
+		name           string
+		data           []byte
+		address        uint32
+		maxElementSize uint
+		targets        []testTarget
+		errText        string
+	}{
+		{
+			name:    "single target",
+			data:    data,
+			address: 0x08000000,
+			targets: []testTarget{{0x08000000, data}},
+		},
+		{
+			name:           "limit larger than data",
+			data:           data,
+			address:        0x08000000,
+			maxElementSize: 16,
+			targets:        []testTarget{{0x08000000, data}},
+		},
+		{
+			name:           "even split",
+			data:           data[:6],
+			address:        0x08000000,
+			maxElementSize: 2,
+			targets: []testTarget{
+				{0x08000000, []byte{1, 2}},
+				{0x08000002, []byte{3, 4}},
+				{0x08000004, []byte{5, 6}},
+			},
+		},
+		{
+			name:           "short last target",
+			data:           data,
+			address:        0x08000000,
+			maxElementSize: 3,
+			targets: []testTarget{
+				{0x08000000, []byte{1, 2, 3}},
+				{0x08000003, []byte{4, 5, 6}},
+				{0x08000006, []byte{7}},
+			},
+		},
+		{
+			name:           "ends at top of address space",
+			data:           data[:4],
+			address:        0xfffffffc,
+			maxElementSize: 2,
+			targets: []testTarget{
+				{0xfffffffc, []byte{1, 2}},
+				{0xfffffffe, []byte{3, 4}},
+			},
+		},
+		{
+			name:    "past top of address space",
+			data:    data[:4],
+			address: 0xfffffffd,
+			errText: "32 bit address space",
+		},
+		{
+			name:    "empty",
+			errText: "empty",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			image, err := ParseBinary(test.data, test.address, test.maxElementSize)
+
+			if test.errText != "" {
+				if err == nil || !strings.Contains(err.Error(), test.errText) {
+					t.Fatalf("expected an error containing %q, got %v", test.errText, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			checkTargets(t, image, test.targets)
+
+			if int(image.Prefix.Elements) != len(image.Targets) {
+				t.Errorf("prefix claims %d elements, image has %d targets", image.Prefix.Elements, len(image.Targets))
+			}
+		})
+	}
+}
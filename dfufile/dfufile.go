@@ -1,9 +1,11 @@
 package dfufile
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
-	"os"
+	"io"
+	"io/ioutil"
 )
 
 type DFUTarget struct {
@@ -17,13 +19,27 @@ type DFUTarget struct {
 type DFUImage struct {
 	Prefix struct {
 		Signature  [6]byte
-		AltSetting bool
+		AltSetting uint8
 		IsNamed    uint32
 		Name       [255]byte
 		Size       uint32
 		Elements   uint32
 	}
 	Targets []DFUTarget
+
+	//Not part of the DfuSe format, set by loaders whose source format
+	//carries a start address (HEX, S-record, ELF)
+	EntryAddress    uint32
+	HasEntryAddress bool
+}
+
+// StartAddress returns the address execution should jump to after flashing,
+// the entry address when known, otherwise the address of the first target
+func (d DFUImage) StartAddress() uint32 {
+	if d.HasEntryAddress || len(d.Targets) == 0 {
+		return d.EntryAddress
+	}
+	return d.Targets[0].Prefix.Address
 }
 
 type DFUFile struct {
@@ -47,25 +63,85 @@ type DFUFile struct {
 	}
 }
 
-func Read(filename string) (DFUFile, error) {
-	var fileData DFUFile
+// ImagesForAltSetting returns the images of the file that target the given
+// alternate setting, in file order
+func (f DFUFile) ImagesForAltSetting(alt uint8) []DFUImage {
+	images := make([]DFUImage, 0)
+	for _, image := range f.Images {
+		if image.Prefix.AltSetting == alt {
+			images = append(images, image)
+		}
+	}
+	return images
+}
+
+// CRCError is returned when the CRC stored in the dfu suffix does not match
+// the contents of the file
+type CRCError struct {
+	Expected uint32
+	Actual   uint32
+}
+
+func (e *CRCError) Error() string {
+	return fmt.Sprintf("CRC mismatch in dfu file, suffix claims 0x%08x but computed 0x%08x", e.Expected, e.Actual)
+}
 
-	fileHandle, err := os.Open(filename)
-	defer fileHandle.Close()
+type readOptions struct {
+	ignoreCRC bool
+}
+
+// ReadOption changes how a dfu file is validated while reading
+type ReadOption func(*readOptions)
+
+// IgnoreCRC skips the suffix CRC check, for vendor files known to carry a bad CRC
+func IgnoreCRC() ReadOption {
+	return func(o *readOptions) {
+		o.ignoreCRC = true
+	}
+}
 
+// Read parses the dfu file stored at filename
+func Read(filename string, options ...ReadOption) (DFUFile, error) {
 	//TODO: Verbose output
 	//fmt.Println(filename)
 
+	rawData, err := ioutil.ReadFile(filename)
+
 	if err != nil {
-		return fileData, err
+		return DFUFile{}, err
 	}
 
+	return ParseBytes(rawData, options...)
+}
+
+// Parse reads a complete dfu file from r and decodes it
+func Parse(r io.Reader, options ...ReadOption) (DFUFile, error) {
+	rawData, err := ioutil.ReadAll(r)
+
+	if err != nil {
+		return DFUFile{}, err
+	}
+
+	return ParseBytes(rawData, options...)
+}
+
+// ParseBytes decodes a dfu file held in memory
+func ParseBytes(rawData []byte, options ...ReadOption) (DFUFile, error) {
+	var fileData DFUFile
+	var opts readOptions
+
+	for _, option := range options {
+		option(&opts)
+	}
+
+	reader := bytes.NewReader(rawData)
+
 	//   <   little endian
 	//   5s  char[5]     signature   "DfuSe"
 	//   B   uint8_t     version     1
 	//   I   uint32_t    size        Size of the DFU file (not including suffix)
 	//   B   uint8_t     targets     Number of targets
-	err = binary.Read(fileHandle, binary.LittleEndian, &fileData.Prefix)
+	err := binary.Read(reader, binary.LittleEndian, &fileData.Prefix)
 
 	if err != nil {
 		return fileData, err
@@ -75,6 +151,49 @@ func Read(filename string) (DFUFile, error) {
 		return fileData, fmt.Errorf("Error in image prefix, dfu file failed")
 	}
 
+	//The suffix must follow the prefix size exactly, anything else would
+	//only show up as a confusing CRC mismatch
+	if int64(fileData.Prefix.Size)+dfuSuffixSize != int64(len(rawData)) {
+		return fileData, fmt.Errorf("Size mismatch, prefix claims %d bytes plus a %d byte suffix but the file has %d bytes, dfu file failed",
+			fileData.Prefix.Size, dfuSuffixSize, len(rawData))
+	}
+
+	//   <   little endian
+	//   H   uint16_t    device  Firmware version
+	//   H   uint16_t    product
+	//   H   uint16_t    vendor
+	//   H   uint16_t    dfu     0x11a   (DFU file format version)
+	//   3s  char[3]     ufd     'UFD'
+	//   B   uint8_t     len     16
+	//   I   uint32_t    crc32
+	err = binary.Read(bytes.NewReader(rawData[len(rawData)-dfuSuffixSize:]), binary.LittleEndian, &fileData.Suffix)
+
+	if err != nil {
+		return fileData, err
+	}
+
+	//TODO: Verbose output
+	//fmt.Printf("version: %x, product: %04x, vendor: %04x, format: %d, length: %d, crc32: %d\r\n",
+	//	fileData.Suffix.DeviceVersion,
+	//	fileData.Suffix.Product,
+	//	fileData.Suffix.Vendor,
+	//	fileData.Suffix.DfuFormat,
+	//	fileData.Suffix.Length,
+	//	fileData.Suffix.Crc32)
+
+	if string(fileData.Suffix.Ufd[:]) != "UFD" {
+		return fileData, fmt.Errorf("Error in suffix prefix, dfu file failed")
+	}
+
+	//Check the CRC before trusting any count or size in the images
+	if !opts.ignoreCRC {
+		crc := computeCRC(rawData[:len(rawData)-4])
+
+		if crc != fileData.Suffix.Crc32 {
+			return fileData, &CRCError{Expected: fileData.Suffix.Crc32, Actual: crc}
+		}
+	}
+
 	//TODO: Verbose output
 	//fmt.Printf("Signature: %x, v%d, image size: %d, targets: %d\r\n",
 	//	fileData.Prefix.Signature,
@@ -82,6 +201,15 @@ func Read(filename string) (DFUFile, error) {
 	//	fileData.Prefix.Size,
 	//	fileData.Prefix.Targets)
 
+	//The images are decoded from the data between the prefix and the suffix
+	offset := len(rawData) - reader.Len()
+
+	if int(fileData.Prefix.Size) < offset {
+		return fileData, fmt.Errorf("Prefix claims %d bytes, less than the prefix itself, dfu file failed", fileData.Prefix.Size)
+	}
+
+	reader = bytes.NewReader(rawData[offset:fileData.Prefix.Size])
+
 	fileData.Images = make([]DFUImage, fileData.Prefix.Targets)
 
 	for imageIdx := range fileData.Images {
@@ -96,7 +224,7 @@ func Read(filename string) (DFUFile, error) {
 		//   255s    char[255]   name        name of the target
 		//   I       uint32_t    size        size of image (not incl prefix)
 		//   I       uint32_t    elements    Number of elements in the image
-		err = binary.Read(fileHandle, binary.LittleEndian, &image.Prefix)
+		err = binary.Read(reader, binary.LittleEndian, &image.Prefix)
 
 		if err != nil {
 			return fileData, err
@@ -115,6 +243,11 @@ func Read(filename string) (DFUFile, error) {
 		//	image.Prefix.Size,
 		//	image.Prefix.Elements)
 
+		if int64(image.Prefix.Elements)*dfuTargetPrefixSize > int64(reader.Len()) {
+			return fileData, fmt.Errorf("Image %d claims %d elements but only %d bytes remain, dfu file failed",
+				imageIdx, image.Prefix.Elements, reader.Len())
+		}
+
 		image.Targets = make([]DFUTarget, image.Prefix.Elements)
 
 		for targetIdx := range image.Targets {
@@ -123,44 +256,29 @@ func Read(filename string) (DFUFile, error) {
 			//   <   little endian
 			//   I   uint32_t    element address
 			//   I   uint32_t    element size
-			err = binary.Read(fileHandle, binary.LittleEndian, &image.Targets[targetIdx].Prefix)
+			err = binary.Read(reader, binary.LittleEndian, &image.Targets[targetIdx].Prefix)
 			if err != nil {
 				return fileData, err
 			}
 
+			if int64(image.Targets[targetIdx].Prefix.Size) > int64(reader.Len()) {
+				return fileData, fmt.Errorf("Element %d of image %d claims %d bytes but only %d remain, dfu file failed",
+					targetIdx, imageIdx, image.Targets[targetIdx].Prefix.Size, reader.Len())
+			}
+
 			image.Targets[targetIdx].Elements = make([]byte, image.Targets[targetIdx].Prefix.Size)
-			_, err = fileHandle.Read(image.Targets[targetIdx].Elements)
+			_, err = io.ReadFull(reader, image.Targets[targetIdx].Elements)
 
 			if err != nil {
-				return fileData, err
+				return fileData, fmt.Errorf("Error reading element %d of image %d, dfu file failed: %v", targetIdx, imageIdx, err)
 			}
 		}
 	}
 
-	//   <   little endian
-	//   H   uint16_t    device  Firmware version
-	//   H   uint16_t    product
-	//   H   uint16_t    vendor
-	//   H   uint16_t    dfu     0x11a   (DFU file format version)
-	//   3s  char[3]     ufd     'UFD'
-	//   B   uint8_t     len     16
-	//   I   uint32_t    crc32
-	err = binary.Read(fileHandle, binary.LittleEndian, &fileData.Suffix)
-
-	//TODO: Verbose output
-	//fmt.Printf("version: %x, product: %04x, vendor: %04x, format: %d, length: %d, crc32: %d\r\n",
-	//	fileData.Suffix.DeviceVersion,
-	//	fileData.Suffix.Product,
-	//	fileData.Suffix.Vendor,
-	//	fileData.Suffix.DfuFormat,
-	//	fileData.Suffix.Length,
-	//	fileData.Suffix.Crc32)
-
-	if string(fileData.Suffix.Ufd[:]) != "UFD" {
-		return fileData, fmt.Errorf("Error in suffix prefix, dfu file failed")
+	if reader.Len() != 0 {
+		return fileData, fmt.Errorf("Images end at byte %d but prefix claims %d bytes, dfu file failed",
+			int(fileData.Prefix.Size)-reader.Len(), fileData.Prefix.Size)
 	}
 
-	//TODO: check CRC
-
 	return fileData, nil
 }
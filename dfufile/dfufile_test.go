@@ -0,0 +1,155 @@
+package dfufile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func newTestImage(alt uint8, address uint32, elements ...[]byte) DFUImage {
+	var image DFUImage
+	image.Prefix.AltSetting = alt
+
+	for _, data := range elements {
+		var target DFUTarget
+		target.Prefix.Address = address
+		target.Prefix.Size = uint32(len(data))
+		target.Elements = data
+		image.Targets = append(image.Targets, target)
+		address += uint32(len(data))
+	}
+	return image
+}
+
+func encodeTestFile(t *testing.T, images ...DFUImage) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, DFUFile{Images: images}); err != nil {
+		t.Fatalf("Encode() failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestParseBytesValidation(t *testing.T) {
+	valid := encodeTestFile(t, newTestImage(0, 0x08000000, []byte{1, 2, 3, 4}))
+
+	badCRC := append([]byte(nil), valid...)
+	badCRC[len(badCRC)-1] ^= 0xff
+
+	badData := append([]byte(nil), valid...)
+	badData[len(badData)-dfuSuffixSize-1] ^= 0xff
+
+	//Element count of the first image, offset 11+6+1+4+255+4
+	manyElements := append([]byte(nil), valid...)
+	binary.LittleEndian.PutUint32(manyElements[281:], 0x7fffffff)
+
+	manyElementsCRC := append([]byte(nil), manyElements...)
+	binary.LittleEndian.PutUint32(manyElementsCRC[len(manyElementsCRC)-4:], computeCRC(manyElementsCRC[:len(manyElementsCRC)-4]))
+
+	tests := []struct {
+		name     string
+		data     []byte
+		options  []ReadOption
+		crcError bool
+		errText  string
+	}{
+		{name: "valid", data: valid},
+		{name: "corrupt crc", data: badCRC, crcError: true},
+		{name: "corrupt data", data: badData, crcError: true},
+		{name: "corrupt data ignored", data: badData, options: []ReadOption{IgnoreCRC()}},
+		{name: "trailing data", data: append(append([]byte(nil), valid...), 0, 0), errText: "Size mismatch"},
+		{name: "truncated", data: valid[:len(valid)-1], errText: "Size mismatch"},
+		{name: "bad signature", data: append([]byte("DfuSx"), valid[5:]...), errText: "prefix"},
+		{name: "element count checked by crc", data: manyElements, crcError: true},
+		{name: "element count with valid crc", data: manyElementsCRC, errText: "claims 2147483647 elements"},
+		{name: "element count ignoring crc", data: manyElements, options: []ReadOption{IgnoreCRC()}, errText: "claims 2147483647 elements"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseBytes(test.data, test.options...)
+
+			_, isCRC := err.(*CRCError)
+			switch {
+			case test.crcError:
+				if !isCRC {
+					t.Fatalf("expected a *CRCError, got %v", err)
+				}
+			case test.errText != "":
+				if err == nil || isCRC || !strings.Contains(err.Error(), test.errText) {
+					t.Fatalf("expected an error containing %q, got %v", test.errText, err)
+				}
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestEncodeParseAltSettings(t *testing.T) {
+	images := []DFUImage{
+		newTestImage(0, 0x08000000, []byte{1, 2, 3, 4}, []byte{5, 6}),
+		newTestImage(2, 0x1fff7800, []byte{0xaa}),
+		newTestImage(3, 0x1fffc000, []byte{0x55, 0xaa, 0x55}),
+		newTestImage(0, 0x08020000, []byte{7}),
+	}
+
+	data := encodeTestFile(t, images...)
+
+	file, err := ParseBytes(data)
+
+	if err != nil {
+		t.Fatalf("ParseBytes() failed: %v", err)
+	}
+
+	if expected := computeCRC(data[:len(data)-4]); file.Suffix.Crc32 != expected {
+		t.Errorf("expected CRC 0x%08x, got 0x%08x", expected, file.Suffix.Crc32)
+	}
+
+	if int(file.Prefix.Targets) != len(images) || len(file.Images) != len(images) {
+		t.Fatalf("expected %d images, prefix claims %d and file has %d", len(images), file.Prefix.Targets, len(file.Images))
+	}
+
+	for idx, image := range file.Images {
+		if image.Prefix.AltSetting != images[idx].Prefix.AltSetting {
+			t.Errorf("image %d: expected alt setting %d, got %d", idx, images[idx].Prefix.AltSetting, image.Prefix.AltSetting)
+		}
+
+		if int(image.Prefix.Elements) != len(images[idx].Targets) {
+			t.Errorf("image %d: prefix claims %d elements, expected %d", idx, image.Prefix.Elements, len(images[idx].Targets))
+		}
+
+		expected := make([]testTarget, len(images[idx].Targets))
+		for targetIdx, target := range images[idx].Targets {
+			expected[targetIdx] = testTarget{target.Prefix.Address, target.Elements}
+		}
+		checkTargets(t, image, expected)
+	}
+
+	tests := []struct {
+		alt       uint8
+		addresses []uint32
+	}{
+		{alt: 0, addresses: []uint32{0x08000000, 0x08020000}},
+		{alt: 1},
+		{alt: 2, addresses: []uint32{0x1fff7800}},
+		{alt: 3, addresses: []uint32{0x1fffc000}},
+	}
+
+	for _, test := range tests {
+		found := file.ImagesForAltSetting(test.alt)
+
+		if len(found) != len(test.addresses) {
+			t.Errorf("alt setting %d: expected %d images, got %d", test.alt, len(test.addresses), len(found))
+			continue
+		}
+
+		for idx, image := range found {
+			if image.Prefix.AltSetting != test.alt || image.StartAddress() != test.addresses[idx] {
+				t.Errorf("alt setting %d: image %d is alt setting %d at 0x%x", test.alt, idx, image.Prefix.AltSetting, image.StartAddress())
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package dfufile
+
+import (
+	"fmt"
+	"sort"
+)
+
+// memorySegment is a run of bytes at an absolute address collected by the
+// firmware loaders before being turned into DFUTargets
+type memorySegment struct {
+	address uint32
+	data    []byte
+}
+
+func (s memorySegment) end() uint64 {
+	return uint64(s.address) + uint64(len(s.data))
+}
+
+// appendSegment adds data at address, extending the last segment in place
+// when the new data follows on directly
+func appendSegment(segments []memorySegment, address uint32, data []byte) []memorySegment {
+	if len(data) == 0 {
+		return segments
+	}
+
+	if last := len(segments) - 1; last >= 0 && segments[last].end() == uint64(address) {
+		segments[last].data = append(segments[last].data, data...)
+		return segments
+	}
+
+	return append(segments, memorySegment{address, append([]byte(nil), data...)})
+}
+
+// imageFromSegments sorts and merges segments into a DFUImage with one
+// DFUTarget per contiguous region
+func imageFromSegments(segments []memorySegment) (DFUImage, error) {
+	var image DFUImage
+
+	sort.SliceStable(segments, func(i, j int) bool {
+		return segments[i].address < segments[j].address
+	})
+
+	merged := make([]memorySegment, 0, len(segments))
+
+	for _, segment := range segments {
+		if len(segment.data) == 0 {
+			continue
+		}
+
+		if segment.end() > 1<<32 {
+			return image, fmt.Errorf("Data at 0x%x with length %d exceeds the 32 bit address space", segment.address, len(segment.data))
+		}
+
+		if last := len(merged) - 1; last >= 0 {
+			if merged[last].end() > uint64(segment.address) {
+				return image, fmt.Errorf("Overlapping data at address 0x%x", segment.address)
+			}
+
+			if merged[last].end() == uint64(segment.address) {
+				merged[last].data = append(merged[last].data, segment.data...)
+				continue
+			}
+		}
+
+		merged = append(merged, segment)
+	}
+
+	return newImage(merged), nil
+}
+
+// newImage creates a DFUImage with one DFUTarget per segment, in order
+func newImage(segments []memorySegment) DFUImage {
+	var image DFUImage
+
+	image.Targets = make([]DFUTarget, len(segments))
+	imageSize := 0
+
+	for idx, segment := range segments {
+		image.Targets[idx].Prefix.Address = segment.address
+		image.Targets[idx].Prefix.Size = uint32(len(segment.data))
+		image.Targets[idx].Elements = segment.data
+		imageSize += dfuTargetPrefixSize + len(segment.data)
+	}
+
+	copy(image.Prefix.Signature[:], "Target")
+	image.Prefix.Size = uint32(imageSize)
+	image.Prefix.Elements = uint32(len(image.Targets))
+
+	return image
+}
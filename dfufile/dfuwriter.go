@@ -0,0 +1,159 @@
+package dfufile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+const (
+	dfuFilePrefixSize   = 11
+	dfuImagePrefixSize  = 274
+	dfuTargetPrefixSize = 8
+	dfuSuffixSize       = 16
+	dfuFormatDfuSe      = 0x011a
+)
+
+// Write encodes fileData as a DfuSe file and stores it at filename
+func Write(filename string, fileData DFUFile) error {
+	fileHandle, err := os.Create(filename)
+
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(fileHandle)
+	err = Encode(writer, fileData)
+
+	if err == nil {
+		err = writer.Flush()
+	}
+
+	closeErr := fileHandle.Close()
+
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
+
+// Encode serializes fileData to w. Signatures, counts, sizes and the suffix
+// CRC are computed from the images and elements, any values already present
+// in those fields are ignored.
+func Encode(w io.Writer, fileData DFUFile) error {
+	if len(fileData.Images) > 0xff {
+		return fmt.Errorf("Too many images for dfu file, %d exceeds 255", len(fileData.Images))
+	}
+
+	var buf bytes.Buffer
+	imagesSize := 0
+
+	for imageIdx := range fileData.Images {
+		image := fileData.Images[imageIdx]
+		imageSize := 0
+
+		for _, target := range image.Targets {
+			imageSize += dfuTargetPrefixSize + len(target.Elements)
+		}
+
+		copy(image.Prefix.Signature[:], "Target")
+		image.Prefix.Size = uint32(imageSize)
+		image.Prefix.Elements = uint32(len(image.Targets))
+
+		if image.Prefix.Name[0] != 0 {
+			image.Prefix.IsNamed = 1
+		}
+
+		//   <   little endian
+		//   6s      char[6]     signature   "Target"
+		//   B       uint8_t     altsetting
+		//   I       uint32_t    named       bool indicating if a name was used
+		//   255s    char[255]   name        name of the target
+		//   I       uint32_t    size        size of image (not incl prefix)
+		//   I       uint32_t    elements    Number of elements in the image
+		err := binary.Write(&buf, binary.LittleEndian, &image.Prefix)
+
+		if err != nil {
+			return err
+		}
+
+		for _, target := range image.Targets {
+			target.Prefix.Size = uint32(len(target.Elements))
+
+			//   <   little endian
+			//   I   uint32_t    element address
+			//   I   uint32_t    element size
+			err = binary.Write(&buf, binary.LittleEndian, &target.Prefix)
+
+			if err != nil {
+				return err
+			}
+
+			buf.Write(target.Elements)
+		}
+
+		imagesSize += dfuImagePrefixSize + imageSize
+	}
+
+	copy(fileData.Prefix.Signature[:], "DfuSe")
+	if fileData.Prefix.Version == 0 {
+		fileData.Prefix.Version = 1
+	}
+	fileData.Prefix.Size = uint32(dfuFilePrefixSize + imagesSize)
+	fileData.Prefix.Targets = uint8(len(fileData.Images))
+
+	var out bytes.Buffer
+	out.Grow(dfuFilePrefixSize + buf.Len() + dfuSuffixSize)
+
+	//   <   little endian
+	//   5s  char[5]     signature   "DfuSe"
+	//   B   uint8_t     version     1
+	//   I   uint32_t    size        Size of the DFU file (not including suffix)
+	//   B   uint8_t     targets     Number of targets
+	err := binary.Write(&out, binary.LittleEndian, &fileData.Prefix)
+
+	if err != nil {
+		return err
+	}
+
+	out.Write(buf.Bytes())
+
+	if fileData.Suffix.DfuFormat == 0 {
+		fileData.Suffix.DfuFormat = dfuFormatDfuSe
+	}
+	copy(fileData.Suffix.Ufd[:], "UFD")
+	fileData.Suffix.Length = dfuSuffixSize
+
+	//   <   little endian
+	//   H   uint16_t    device  Firmware version
+	//   H   uint16_t    product
+	//   H   uint16_t    vendor
+	//   H   uint16_t    dfu     0x11a   (DFU file format version)
+	//   3s  char[3]     ufd     'UFD'
+	//   B   uint8_t     len     16
+	//   I   uint32_t    crc32
+	err = binary.Write(&out, binary.LittleEndian, &fileData.Suffix)
+
+	if err != nil {
+		return err
+	}
+
+	//CRC covers the whole file except the crc itself
+	data := out.Bytes()
+	binary.LittleEndian.PutUint32(data[len(data)-4:], computeCRC(data[:len(data)-4]))
+
+	_, err = w.Write(data)
+
+	return err
+}
+
+// computeCRC returns the DFU suffix CRC, which is the IEEE CRC32 without the
+// final inversion
+func computeCRC(data []byte) uint32 {
+	return ^crc32.ChecksumIEEE(data)
+}
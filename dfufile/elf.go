@@ -0,0 +1,123 @@
+package dfufile
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ReadELF loads the PT_LOAD segments of an ELF firmware file into a DFUImage
+func ReadELF(filename string) (DFUImage, error) {
+	elfFile, err := elf.Open(filename)
+
+	if err != nil {
+		return DFUImage{}, err
+	}
+
+	defer elfFile.Close()
+
+	return decodeELF(elfFile)
+}
+
+// ParseELF decodes an ELF firmware file from r. Each loadable segment is
+// placed at its physical (load) address and e_entry becomes the entry address.
+func ParseELF(r io.ReaderAt) (DFUImage, error) {
+	elfFile, err := elf.NewFile(r)
+
+	if err != nil {
+		return DFUImage{}, err
+	}
+
+	return decodeELF(elfFile)
+}
+
+type elfSegment struct {
+	memorySegment
+	name string
+}
+
+func decodeELF(elfFile *elf.File) (DFUImage, error) {
+	if elfFile.Type != elf.ET_EXEC {
+		return DFUImage{}, fmt.Errorf("ELF file is %v, expected an executable", elfFile.Type)
+	}
+
+	segments := make([]elfSegment, 0)
+
+	for idx, prog := range elfFile.Progs {
+		//Only the initialised part of a loadable segment ends up in flash,
+		//anything past Filesz is zeroed by the startup code
+		if prog.Type != elf.PT_LOAD || prog.Filesz == 0 {
+			continue
+		}
+
+		name := fmt.Sprintf("segment %d (%s)", idx, elfSectionNames(elfFile, prog))
+
+		if prog.Paddr+prog.Filesz > 1<<32 {
+			return DFUImage{}, fmt.Errorf("ELF %s at 0x%x does not fit in a 32 bit address space", name, prog.Paddr)
+		}
+
+		data := make([]byte, prog.Filesz)
+		_, err := prog.ReadAt(data, 0)
+
+		if err != nil {
+			return DFUImage{}, fmt.Errorf("Failed to read ELF %s: %v", name, err)
+		}
+
+		segments = append(segments, elfSegment{memorySegment{uint32(prog.Paddr), data}, name})
+	}
+
+	if len(segments) == 0 {
+		return DFUImage{}, fmt.Errorf("ELF file has no loadable segments")
+	}
+
+	sort.SliceStable(segments, func(i, j int) bool {
+		return segments[i].address < segments[j].address
+	})
+
+	//Check overlaps here so the error can name the sections involved
+	for idx := 1; idx < len(segments); idx++ {
+		if segments[idx-1].end() > uint64(segments[idx].address) {
+			return DFUImage{}, fmt.Errorf("ELF %s at 0x%x overlaps %s at 0x%x",
+				segments[idx].name, segments[idx].address, segments[idx-1].name, segments[idx-1].address)
+		}
+	}
+
+	memSegments := make([]memorySegment, len(segments))
+	for idx := range segments {
+		memSegments[idx] = segments[idx].memorySegment
+	}
+
+	image, err := imageFromSegments(memSegments)
+
+	if elfFile.Entry > 0xffffffff {
+		return image, fmt.Errorf("ELF entry address 0x%x does not fit in 32 bits", elfFile.Entry)
+	}
+
+	image.EntryAddress = uint32(elfFile.Entry)
+	image.HasEntryAddress = true
+
+	return image, err
+}
+
+// elfSectionNames lists the allocated sections whose contents live in prog
+func elfSectionNames(elfFile *elf.File, prog *elf.Prog) string {
+	names := make([]string, 0)
+
+	for _, section := range elfFile.Sections {
+		if section.Flags&elf.SHF_ALLOC == 0 || section.Type == elf.SHT_NOBITS || section.Size == 0 {
+			continue
+		}
+
+		if section.Offset >= prog.Off && section.Offset < prog.Off+prog.Filesz {
+			names = append(names, section.Name)
+		}
+	}
+
+	if len(names) == 0 {
+		return "no sections"
+	}
+
+	return strings.Join(names, " ")
+}
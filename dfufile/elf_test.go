@@ -0,0 +1,160 @@
+package dfufile
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+type testProg struct {
+	progType elf.ProgType
+	vaddr    uint32
+	paddr    uint32
+	memsz    uint32
+	data     []byte
+}
+
+// buildELF writes a little endian 32 bit ARM ELF file with the given program
+// headers and no sections
+func buildELF(fileType elf.Type, entry uint32, progs ...testProg) []byte {
+	const headerSize, progSize = 52, 32
+
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+
+	buf.Write([]byte{0x7f, 'E', 'L', 'F', byte(elf.ELFCLASS32), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT)})
+	buf.Write(make([]byte, elf.EI_NIDENT-buf.Len()))
+	binary.Write(&buf, le, uint16(fileType))
+	binary.Write(&buf, le, uint16(elf.EM_ARM))
+	binary.Write(&buf, le, uint32(elf.EV_CURRENT))
+	binary.Write(&buf, le, entry)
+	binary.Write(&buf, le, uint32(headerSize)) //e_phoff
+	binary.Write(&buf, le, uint32(0))          //e_shoff
+	binary.Write(&buf, le, uint32(0))          //e_flags
+	binary.Write(&buf, le, uint16(headerSize))
+	binary.Write(&buf, le, uint16(progSize))
+	binary.Write(&buf, le, uint16(len(progs)))
+	binary.Write(&buf, le, uint16(0)) //e_shentsize
+	binary.Write(&buf, le, uint16(0)) //e_shnum
+	binary.Write(&buf, le, uint16(0)) //e_shstrndx
+
+	offset := uint32(headerSize + progSize*len(progs))
+	for _, prog := range progs {
+		memsz := prog.memsz
+		if memsz < uint32(len(prog.data)) {
+			memsz = uint32(len(prog.data))
+		}
+
+		binary.Write(&buf, le, uint32(prog.progType))
+		binary.Write(&buf, le, offset)
+		binary.Write(&buf, le, prog.vaddr)
+		binary.Write(&buf, le, prog.paddr)
+		binary.Write(&buf, le, uint32(len(prog.data)))
+		binary.Write(&buf, le, memsz)
+		binary.Write(&buf, le, uint32(elf.PF_R))
+		binary.Write(&buf, le, uint32(4))
+		offset += uint32(len(prog.data))
+	}
+
+	for _, prog := range progs {
+		buf.Write(prog.data)
+	}
+
+	return buf.Bytes()
+}
+
+func TestParseELF(t *testing.T) {
+	text := testProg{progType: elf.PT_LOAD, vaddr: 0x08000000, paddr: 0x08000000, data: []byte{1, 2, 3, 4}}
+
+	tests := []struct {
+		name     string
+		fileType elf.Type
+		progs    []testProg
+		targets  []testTarget
+		errText  string
+	}{
+		{
+			name:     "text only",
+			fileType: elf.ET_EXEC,
+			progs:    []testProg{text},
+			targets:  []testTarget{{0x08000000, []byte{1, 2, 3, 4}}},
+		},
+		{
+			name:     "data placed at its load address",
+			fileType: elf.ET_EXEC,
+			progs: []testProg{
+				text,
+				{progType: elf.PT_LOAD, vaddr: 0x20000000, paddr: 0x08000004, memsz: 8, data: []byte{5, 6}},
+			},
+			targets: []testTarget{{0x08000000, []byte{1, 2, 3, 4, 5, 6}}},
+		},
+		{
+			name:     "bss and non loadable segments skipped",
+			fileType: elf.ET_EXEC,
+			progs: []testProg{
+				{progType: elf.PT_NOTE, vaddr: 0x1000, paddr: 0x1000, data: []byte{9, 9}},
+				text,
+				{progType: elf.PT_LOAD, vaddr: 0x20000000, paddr: 0x20000000, memsz: 0x100},
+			},
+			targets: []testTarget{{0x08000000, []byte{1, 2, 3, 4}}},
+		},
+		{
+			name:     "segments sorted by address",
+			fileType: elf.ET_EXEC,
+			progs: []testProg{
+				{progType: elf.PT_LOAD, vaddr: 0x08004000, paddr: 0x08004000, data: []byte{7}},
+				text,
+			},
+			targets: []testTarget{
+				{0x08000000, []byte{1, 2, 3, 4}},
+				{0x08004000, []byte{7}},
+			},
+		},
+		{
+			name:     "overlapping segments",
+			fileType: elf.ET_EXEC,
+			progs: []testProg{
+				text,
+				{progType: elf.PT_LOAD, vaddr: 0x08000002, paddr: 0x08000002, data: []byte{7}},
+			},
+			errText: "overlaps",
+		},
+		{
+			name:     "no loadable segments",
+			fileType: elf.ET_EXEC,
+			progs:    []testProg{{progType: elf.PT_LOAD, vaddr: 0x20000000, paddr: 0x20000000, memsz: 0x100}},
+			errText:  "no loadable segments",
+		},
+		{
+			name:     "relocatable object",
+			fileType: elf.ET_REL,
+			progs:    []testProg{text},
+			errText:  "expected an executable",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			image, err := ParseELF(bytes.NewReader(buildELF(test.fileType, 0x08000131, test.progs...)))
+
+			if test.errText != "" {
+				if err == nil || !strings.Contains(err.Error(), test.errText) {
+					t.Fatalf("expected an error containing %q, got %v", test.errText, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			checkTargets(t, image, test.targets)
+
+			if !image.HasEntryAddress || image.EntryAddress != 0x08000131 {
+				t.Errorf("expected entry 0x8000131, got 0x%x (%v)", image.EntryAddress, image.HasEntryAddress)
+			}
+		})
+	}
+}
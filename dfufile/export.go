@@ -0,0 +1,242 @@
+package dfufile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Bytes of data per record in HEX and S-record output
+const exportRecordSize = 16
+
+// fileContents flattens the images of fileData for alternate setting alt
+// into one sorted list of contiguous targets, along with the name of the
+// first image and the first entry address found. Other alternate settings
+// address other memories, possibly at the same addresses, so they are left out.
+func fileContents(fileData DFUFile, alt uint8) (image DFUImage, err error) {
+	segments := make([]memorySegment, 0)
+	var first DFUImage
+	found := false
+
+	for _, fileImage := range fileData.Images {
+		if fileImage.Prefix.AltSetting != alt {
+			continue
+		}
+
+		if !found {
+			first, found = fileImage, true
+		}
+
+		for _, target := range fileImage.Targets {
+			segments = append(segments, memorySegment{target.Prefix.Address, target.Elements})
+		}
+
+		if fileImage.HasEntryAddress && !image.HasEntryAddress {
+			image.EntryAddress = fileImage.EntryAddress
+			image.HasEntryAddress = true
+		}
+	}
+
+	if len(segments) == 0 {
+		return image, fmt.Errorf("DFU file has no data to export for alt setting %d", alt)
+	}
+
+	entryAddress, hasEntry := image.EntryAddress, image.HasEntryAddress
+
+	//Copy the elements so merging never writes into the caller's slices
+	for idx := range segments {
+		segments[idx].data = append([]byte(nil), segments[idx].data...)
+	}
+
+	image, err = imageFromSegments(segments)
+	image.EntryAddress, image.HasEntryAddress = entryAddress, hasEntry
+	image.Prefix.AltSetting = alt
+	image.Prefix.IsNamed, image.Prefix.Name = first.Prefix.IsNamed, first.Prefix.Name
+
+	return image, err
+}
+
+// EncodeBinary writes the images of fileData for alternate setting alt as a
+// raw binary starting at the lowest target address, with gaps between
+// targets set to gapFill
+func EncodeBinary(w io.Writer, fileData DFUFile, alt uint8, gapFill byte) error {
+	image, err := fileContents(fileData, alt)
+
+	if err != nil {
+		return err
+	}
+
+	end := image.Targets[0].Prefix.Address
+
+	for _, target := range image.Targets {
+		if gap := int(target.Prefix.Address - end); gap > 0 {
+			_, err = w.Write(bytes.Repeat([]byte{gapFill}, gap))
+
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = w.Write(target.Elements)
+
+		if err != nil {
+			return err
+		}
+
+		end = target.Prefix.Address + uint32(len(target.Elements))
+	}
+
+	return nil
+}
+
+// EncodeHex writes the images of fileData for alternate setting alt as Intel
+// HEX records
+func EncodeHex(w io.Writer, fileData DFUFile, alt uint8) error {
+	image, err := fileContents(fileData, alt)
+
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(w)
+	upperAddress := uint32(0)
+
+	for _, target := range image.Targets {
+		address := target.Prefix.Address
+		data := target.Elements
+
+		for len(data) > 0 {
+			if address>>16 != upperAddress {
+				upperAddress = address >> 16
+				writeHexRecord(writer, ihexExtendedLinearAddress, 0, []byte{byte(upperAddress >> 8), byte(upperAddress)})
+			}
+
+			//Records may not cross a 64K boundary
+			count := exportRecordSize
+			if remaining := 0x10000 - int(address&0xffff); remaining < count {
+				count = remaining
+			}
+			if len(data) < count {
+				count = len(data)
+			}
+
+			writeHexRecord(writer, ihexData, uint16(address), data[:count])
+
+			address += uint32(count)
+			data = data[count:]
+		}
+	}
+
+	if image.HasEntryAddress {
+		entry := image.EntryAddress
+		writeHexRecord(writer, ihexStartLinearAddress, 0, []byte{byte(entry >> 24), byte(entry >> 16), byte(entry >> 8), byte(entry)})
+	}
+
+	writeHexRecord(writer, ihexEndOfFile, 0, nil)
+
+	return writer.Flush()
+}
+
+func writeHexRecord(w *bufio.Writer, recordType byte, offset uint16, data []byte) {
+	record := make([]byte, 0, len(data)+5)
+	record = append(record, byte(len(data)), byte(offset>>8), byte(offset), recordType)
+	record = append(record, data...)
+
+	var sum uint8
+	for _, b := range record {
+		sum += b
+	}
+	record = append(record, -sum)
+
+	w.WriteString(":" + strings.ToUpper(hex.EncodeToString(record)) + "\n")
+}
+
+// EncodeSRec writes the images of fileData for alternate setting alt as
+// Motorola S-records, using the shortest address format (S19, S28 or S37)
+// that covers every target
+func EncodeSRec(w io.Writer, fileData DFUFile, alt uint8) error {
+	image, err := fileContents(fileData, alt)
+
+	if err != nil {
+		return err
+	}
+
+	last := image.Targets[len(image.Targets)-1]
+	highest := uint64(last.Prefix.Address) + uint64(len(last.Elements)) - 1
+	if image.EntryAddress > uint32(highest) {
+		highest = uint64(image.EntryAddress)
+	}
+
+	dataType, endType, addressSize := byte('1'), byte('9'), 2
+	if highest > 0xffffff {
+		dataType, endType, addressSize = '3', '7', 4
+	} else if highest > 0xffff {
+		dataType, endType, addressSize = '2', '8', 3
+	}
+
+	writer := bufio.NewWriter(w)
+
+	header := []byte("go-dfuse")
+	if image.Prefix.IsNamed != 0 {
+		header = bytes.TrimRight(image.Prefix.Name[:], "\x00")
+	}
+	if len(header) > 0xff-3 {
+		header = header[:0xff-3]
+	}
+	writeSRecord(writer, '0', 2, 0, header)
+
+	records := 0
+
+	for _, target := range image.Targets {
+		address := target.Prefix.Address
+		data := target.Elements
+
+		for len(data) > 0 {
+			count := exportRecordSize
+			if len(data) < count {
+				count = len(data)
+			}
+
+			writeSRecord(writer, dataType, addressSize, address, data[:count])
+			records++
+
+			address += uint32(count)
+			data = data[count:]
+		}
+	}
+
+	if records <= 0xffff {
+		writeSRecord(writer, '5', 2, uint32(records), nil)
+	} else if records <= 0xffffff {
+		writeSRecord(writer, '6', 3, uint32(records), nil)
+	}
+
+	writeSRecord(writer, endType, addressSize, image.EntryAddress, nil)
+
+	return writer.Flush()
+}
+
+func writeSRecord(w *bufio.Writer, recordType byte, addressSize int, address uint32, data []byte) {
+	record := make([]byte, 0, len(data)+addressSize+2)
+	record = append(record, byte(len(data)+addressSize+1))
+
+	for shift := uint(addressSize-1) * 8; ; shift -= 8 {
+		record = append(record, byte(address>>shift))
+		if shift == 0 {
+			break
+		}
+	}
+
+	record = append(record, data...)
+
+	var sum uint8
+	for _, b := range record {
+		sum += b
+	}
+	record = append(record, ^sum)
+
+	w.WriteString("S" + string(recordType) + strings.ToUpper(hex.EncodeToString(record)) + "\n")
+}
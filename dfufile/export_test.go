@@ -0,0 +1,144 @@
+package dfufile
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestExportRoundTrip(t *testing.T) {
+	counting := make([]byte, 40)
+	for idx := range counting {
+		counting[idx] = byte(idx)
+	}
+
+	withEntry := newTestImage(0, 0x08000000, []byte{1, 2, 3})
+	withEntry.EntryAddress = 0x08000101
+	withEntry.HasEntryAddress = true
+
+	tests := []struct {
+		name    string
+		images  []DFUImage
+		alt     uint8
+		targets []testTarget
+		entry   uint32
+	}{
+		{
+			name:    "16 bit addresses",
+			images:  []DFUImage{newTestImage(0, 0x0100, counting)},
+			targets: []testTarget{{0x0100, counting}},
+		},
+		{
+			name:    "crosses a 64K boundary",
+			images:  []DFUImage{newTestImage(0, 0x0800fff8, counting)},
+			targets: []testTarget{{0x0800fff8, counting}},
+		},
+		{
+			name: "images of one alt setting merged and sorted",
+			images: []DFUImage{
+				newTestImage(0, 0x08004000, []byte{5}),
+				newTestImage(1, 0x1fffc000, []byte{0xaa, 0xbb}),
+				newTestImage(0, 0x08000000, []byte{1, 2}, []byte{3, 4}),
+			},
+			targets: []testTarget{
+				{0x08000000, []byte{1, 2, 3, 4}},
+				{0x08004000, []byte{5}},
+			},
+		},
+		{
+			name: "other alt setting at the same addresses",
+			images: []DFUImage{
+				newTestImage(0, 0x08000000, []byte{1, 2}),
+				newTestImage(2, 0x08000000, []byte{0xaa, 0xbb}),
+			},
+			alt:     2,
+			targets: []testTarget{{0x08000000, []byte{0xaa, 0xbb}}},
+		},
+		{
+			name:    "entry address",
+			images:  []DFUImage{withEntry},
+			targets: []testTarget{{0x08000000, []byte{1, 2, 3}}},
+			entry:   0x08000101,
+		},
+	}
+
+	formats := []struct {
+		name   string
+		encode func(io.Writer, DFUFile, uint8) error
+		parse  func(io.Reader) (DFUImage, error)
+	}{
+		{"hex", EncodeHex, ParseHex},
+		{"srec", EncodeSRec, ParseSRec},
+	}
+
+	for _, format := range formats {
+		for _, test := range tests {
+			t.Run(format.name+"/"+test.name, func(t *testing.T) {
+				var buf bytes.Buffer
+
+				err := format.encode(&buf, DFUFile{Images: test.images}, test.alt)
+
+				if err != nil {
+					t.Fatalf("encode failed: %v", err)
+				}
+
+				image, err := format.parse(&buf)
+
+				if err != nil {
+					t.Fatalf("parse failed: %v\n%s", err, buf.String())
+				}
+
+				checkTargets(t, image, test.targets)
+
+				//S-records always end with an entry address, HEX only has one when set
+				hasEntry := test.entry != 0 || format.name == "srec"
+				if image.HasEntryAddress != hasEntry || image.EntryAddress != test.entry {
+					t.Errorf("expected entry 0x%x (%v), got 0x%x (%v)", test.entry, hasEntry, image.EntryAddress, image.HasEntryAddress)
+				}
+			})
+		}
+	}
+}
+
+func TestEncodeBinary(t *testing.T) {
+	file := DFUFile{Images: []DFUImage{
+		newTestImage(0, 0x08000006, []byte{5}),
+		newTestImage(1, 0x1fffc000, []byte{0xaa, 0xbb}),
+		newTestImage(0, 0x08000000, []byte{1, 2}),
+	}}
+
+	tests := []struct {
+		name     string
+		alt      uint8
+		expected []byte
+		errText  string
+	}{
+		{name: "gaps filled", alt: 0, expected: []byte{1, 2, 0xff, 0xff, 0xff, 0xff, 5}},
+		{name: "option bytes alone", alt: 1, expected: []byte{0xaa, 0xbb}},
+		{name: "no images", alt: 3, errText: "no data to export for alt setting 3"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			err := EncodeBinary(&buf, file, test.alt, 0xff)
+
+			if test.errText != "" {
+				if err == nil || !strings.Contains(err.Error(), test.errText) {
+					t.Fatalf("expected an error containing %q, got %v", test.errText, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("EncodeBinary() failed: %v", err)
+			}
+
+			if !bytes.Equal(buf.Bytes(), test.expected) {
+				t.Errorf("expected % x, got % x", test.expected, buf.Bytes())
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package dfufile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Intel HEX record types
+const (
+	ihexData                   = 0x00
+	ihexEndOfFile              = 0x01
+	ihexExtendedSegmentAddress = 0x02
+	ihexExtendedLinearAddress  = 0x04
+	ihexStartLinearAddress     = 0x05
+)
+
+// ReadHex loads an Intel HEX file into a DFUImage
+func ReadHex(filename string) (DFUImage, error) {
+	fileHandle, err := os.Open(filename)
+
+	if err != nil {
+		return DFUImage{}, err
+	}
+
+	defer fileHandle.Close()
+
+	return ParseHex(fileHandle)
+}
+
+// ParseHex decodes Intel HEX records from r into a DFUImage with one
+// DFUTarget for each contiguous region of data. A start linear address
+// record sets the entry address.
+func ParseHex(r io.Reader) (DFUImage, error) {
+	var segments []memorySegment
+	var baseAddress uint32
+	var entryAddress uint32
+	var hasEntry bool
+	var foundEOF bool
+
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+
+		if len(line) == 0 {
+			continue
+		}
+
+		if foundEOF {
+			return DFUImage{}, fmt.Errorf("Intel HEX line %d: data after end of file record", lineNum)
+		}
+
+		if line[0] != ':' {
+			return DFUImage{}, fmt.Errorf("Intel HEX line %d: missing start code ':'", lineNum)
+		}
+
+		//   B   byte count
+		//   H   address (big endian)
+		//   B   record type
+		//   ... data
+		//   B   checksum
+		record, err := hex.DecodeString(line[1:])
+
+		if err != nil {
+			return DFUImage{}, fmt.Errorf("Intel HEX line %d: %v", lineNum, err)
+		}
+
+		if len(record) < 5 || len(record) != int(record[0])+5 {
+			return DFUImage{}, fmt.Errorf("Intel HEX line %d: record length does not match byte count", lineNum)
+		}
+
+		var sum uint8
+		for _, b := range record {
+			sum += b
+		}
+
+		if sum != 0 {
+			expected := record[len(record)-1]
+			return DFUImage{}, fmt.Errorf("Intel HEX line %d: checksum mismatch, record claims 0x%02x but computed 0x%02x",
+				lineNum, expected, expected-sum)
+		}
+
+		offset := binary.BigEndian.Uint16(record[1:3])
+		recordType := record[3]
+		data := record[4 : len(record)-1]
+
+		switch recordType {
+		case ihexData:
+			segments = appendSegment(segments, baseAddress+uint32(offset), data)
+		case ihexEndOfFile:
+			foundEOF = true
+		case ihexExtendedSegmentAddress:
+			if len(data) != 2 {
+				return DFUImage{}, fmt.Errorf("Intel HEX line %d: extended segment address record must hold 2 bytes", lineNum)
+			}
+			baseAddress = uint32(binary.BigEndian.Uint16(data)) << 4
+		case ihexExtendedLinearAddress:
+			if len(data) != 2 {
+				return DFUImage{}, fmt.Errorf("Intel HEX line %d: extended linear address record must hold 2 bytes", lineNum)
+			}
+			baseAddress = uint32(binary.BigEndian.Uint16(data)) << 16
+		case ihexStartLinearAddress:
+			if len(data) != 4 {
+				return DFUImage{}, fmt.Errorf("Intel HEX line %d: start linear address record must hold 4 bytes", lineNum)
+			}
+			entryAddress = binary.BigEndian.Uint32(data)
+			hasEntry = true
+		default:
+			return DFUImage{}, fmt.Errorf("Intel HEX line %d: unsupported record type 0x%02x", lineNum, recordType)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return DFUImage{}, err
+	}
+
+	if !foundEOF {
+		return DFUImage{}, fmt.Errorf("Intel HEX file is missing the end of file record")
+	}
+
+	image, err := imageFromSegments(segments)
+
+	image.EntryAddress = entryAddress
+	image.HasEntryAddress = hasEntry
+
+	return image, err
+}
@@ -0,0 +1,138 @@
+package dfufile
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// hexRecord builds one Intel HEX record with a correct checksum
+func hexRecord(recordType byte, offset uint16, data ...byte) string {
+	record := append([]byte{byte(len(data)), byte(offset >> 8), byte(offset), recordType}, data...)
+
+	var sum byte
+	for _, b := range record {
+		sum += b
+	}
+
+	return fmt.Sprintf(":%X%02X\n", record, -sum)
+}
+
+type testTarget struct {
+	address uint32
+	data    []byte
+}
+
+func checkTargets(t *testing.T, image DFUImage, expected []testTarget) {
+	t.Helper()
+
+	if len(image.Targets) != len(expected) {
+		t.Fatalf("expected %d targets, got %d", len(expected), len(image.Targets))
+	}
+
+	for idx, target := range image.Targets {
+		if target.Prefix.Address != expected[idx].address {
+			t.Errorf("target %d: expected address 0x%x, got 0x%x", idx, expected[idx].address, target.Prefix.Address)
+		}
+		if int(target.Prefix.Size) != len(target.Elements) {
+			t.Errorf("target %d: size %d does not match %d elements", idx, target.Prefix.Size, len(target.Elements))
+		}
+		if !bytes.Equal(target.Elements, expected[idx].data) {
+			t.Errorf("target %d: expected % x, got % x", idx, expected[idx].data, target.Elements)
+		}
+	}
+}
+
+func TestParseHex(t *testing.T) {
+	eof := hexRecord(ihexEndOfFile, 0)
+
+	tests := []struct {
+		name     string
+		src      string
+		targets  []testTarget
+		entry    uint32
+		hasEntry bool
+		errText  string
+	}{
+		{
+			name: "contiguous records merge",
+			src:  hexRecord(ihexData, 0x0000, 1, 2, 3, 4) + hexRecord(ihexData, 0x0004, 5, 6) + eof,
+			targets: []testTarget{
+				{0x0000, []byte{1, 2, 3, 4, 5, 6}},
+			},
+		},
+		{
+			name: "extended linear address",
+			src: hexRecord(ihexExtendedLinearAddress, 0, 0x08, 0x00) +
+				hexRecord(ihexData, 0x0000, 1, 2) +
+				hexRecord(ihexData, 0x0100, 3) +
+				hexRecord(ihexExtendedLinearAddress, 0, 0x08, 0x01) +
+				hexRecord(ihexData, 0x0000, 4) + eof,
+			targets: []testTarget{
+				{0x08000000, []byte{1, 2}},
+				{0x08000100, []byte{3}},
+				{0x08010000, []byte{4}},
+			},
+		},
+		{
+			name: "extended segment address",
+			src:  hexRecord(ihexExtendedSegmentAddress, 0, 0x12, 0x34) + hexRecord(ihexData, 0x0010, 0xaa) + eof,
+			targets: []testTarget{
+				{0x12340 + 0x10, []byte{0xaa}},
+			},
+		},
+		{
+			name: "start linear address",
+			src: hexRecord(ihexExtendedLinearAddress, 0, 0x08, 0x00) +
+				hexRecord(ihexData, 0x0000, 1) +
+				hexRecord(ihexStartLinearAddress, 0, 0x08, 0x00, 0x01, 0x31) + eof,
+			targets:  []testTarget{{0x08000000, []byte{1}}},
+			entry:    0x08000131,
+			hasEntry: true,
+		},
+		{
+			name:    "bad checksum",
+			src:     hexRecord(ihexData, 0, 1) + ":0100100002EE\n" + eof,
+			errText: "line 2: checksum mismatch",
+		},
+		{
+			name:    "missing end of file",
+			src:     hexRecord(ihexData, 0, 1),
+			errText: "end of file",
+		},
+		{
+			name:    "data after end of file",
+			src:     eof + hexRecord(ihexData, 0, 1),
+			errText: "line 2: data after end of file",
+		},
+		{
+			name:    "overlapping data",
+			src:     hexRecord(ihexData, 0, 1, 2) + hexRecord(ihexData, 1, 3) + eof,
+			errText: "Overlapping data",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			image, err := ParseHex(strings.NewReader(test.src))
+
+			if test.errText != "" {
+				if err == nil || !strings.Contains(err.Error(), test.errText) {
+					t.Fatalf("expected an error containing %q, got %v", test.errText, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			checkTargets(t, image, test.targets)
+
+			if image.HasEntryAddress != test.hasEntry || image.EntryAddress != test.entry {
+				t.Errorf("expected entry 0x%x (%v), got 0x%x (%v)", test.entry, test.hasEntry, image.EntryAddress, image.HasEntryAddress)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package dfufile
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ReadSRec loads a Motorola S-record (S19/S28/S37) file into a DFUImage
+func ReadSRec(filename string) (DFUImage, error) {
+	fileHandle, err := os.Open(filename)
+
+	if err != nil {
+		return DFUImage{}, err
+	}
+
+	defer fileHandle.Close()
+
+	return ParseSRec(fileHandle)
+}
+
+// ParseSRec decodes Motorola S-records from r into a DFUImage with one
+// DFUTarget for each contiguous region of data. The S0 header becomes the
+// image name and an S7/S8/S9 record sets the entry address.
+func ParseSRec(r io.Reader) (DFUImage, error) {
+	var segments []memorySegment
+	var header []byte
+	var entryAddress uint32
+	var hasEntry bool
+
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+
+		if len(line) == 0 {
+			continue
+		}
+
+		if len(line) < 4 || line[0] != 'S' {
+			return DFUImage{}, fmt.Errorf("S-record line %d: missing 'S' record start", lineNum)
+		}
+
+		//   B   byte count of address, data and checksum
+		//   ... address (big endian, 2 to 4 bytes)
+		//   ... data
+		//   B   checksum
+		recordType := line[1]
+		record, err := hex.DecodeString(line[2:])
+
+		if err != nil {
+			return DFUImage{}, fmt.Errorf("S-record line %d: %v", lineNum, err)
+		}
+
+		if len(record) < 2 || len(record) != int(record[0])+1 {
+			return DFUImage{}, fmt.Errorf("S-record line %d: record length does not match byte count", lineNum)
+		}
+
+		var sum uint8
+		for _, b := range record[:len(record)-1] {
+			sum += b
+		}
+
+		if expected := record[len(record)-1]; ^sum != expected {
+			return DFUImage{}, fmt.Errorf("S-record line %d: checksum mismatch, record claims 0x%02x but computed 0x%02x",
+				lineNum, expected, ^sum)
+		}
+
+		var addressSize int
+		switch recordType {
+		case '0', '1', '5', '9':
+			addressSize = 2
+		case '2', '6', '8':
+			addressSize = 3
+		case '3', '7':
+			addressSize = 4
+		default:
+			return DFUImage{}, fmt.Errorf("S-record line %d: unsupported record type S%c", lineNum, recordType)
+		}
+
+		if len(record) < addressSize+2 {
+			return DFUImage{}, fmt.Errorf("S-record line %d: record too short for its address", lineNum)
+		}
+
+		var address uint32
+		for _, b := range record[1 : 1+addressSize] {
+			address = address<<8 | uint32(b)
+		}
+		data := record[1+addressSize : len(record)-1]
+
+		switch recordType {
+		case '0':
+			header = append([]byte(nil), data...)
+		case '1', '2', '3':
+			segments = appendSegment(segments, address, data)
+		case '5', '6':
+			//Record counts, nothing to load
+		case '7', '8', '9':
+			entryAddress = address
+			hasEntry = true
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return DFUImage{}, err
+	}
+
+	image, err := imageFromSegments(segments)
+
+	if err != nil {
+		return image, err
+	}
+
+	if len(header) > 0 {
+		copy(image.Prefix.Name[:], strings.TrimRight(string(header), "\x00"))
+		image.Prefix.IsNamed = 1
+	}
+
+	image.EntryAddress = entryAddress
+	image.HasEntryAddress = hasEntry
+
+	return image, nil
+}
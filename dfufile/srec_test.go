@@ -0,0 +1,134 @@
+package dfufile
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// srecRecord builds one S-record with a correct checksum, address is written
+// with the width of recordType
+func srecRecord(recordType byte, address uint32, data ...byte) string {
+	var addressSize int
+	switch recordType {
+	case '0', '1', '5', '9':
+		addressSize = 2
+	case '2', '6', '8':
+		addressSize = 3
+	default:
+		addressSize = 4
+	}
+
+	record := []byte{byte(addressSize + len(data) + 1)}
+	for shift := (addressSize - 1) * 8; shift >= 0; shift -= 8 {
+		record = append(record, byte(address>>uint(shift)))
+	}
+	record = append(record, data...)
+
+	var sum byte
+	for _, b := range record {
+		sum += b
+	}
+
+	return fmt.Sprintf("S%c%X%02X\n", recordType, record, ^sum)
+}
+
+func TestParseSRec(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		targets  []testTarget
+		entry    uint32
+		hasEntry bool
+		imgName  string
+		errText  string
+	}{
+		{
+			name: "S1 records merge",
+			src:  srecRecord('1', 0x1000, 1, 2, 3) + srecRecord('1', 0x1003, 4) + srecRecord('9', 0),
+			targets: []testTarget{
+				{0x1000, []byte{1, 2, 3, 4}},
+			},
+			hasEntry: true,
+		},
+		{
+			name: "S2 and S3 addresses",
+			src:  srecRecord('2', 0x123456, 0xaa) + srecRecord('3', 0x08000000, 0xbb, 0xcc),
+			targets: []testTarget{
+				{0x123456, []byte{0xaa}},
+				{0x08000000, []byte{0xbb, 0xcc}},
+			},
+		},
+		{
+			name: "header and S7 entry",
+			src: srecRecord('0', 0, 'f', 'w') +
+				srecRecord('3', 0x08000000, 1) +
+				srecRecord('5', 1) +
+				srecRecord('7', 0x08000131),
+			targets:  []testTarget{{0x08000000, []byte{1}}},
+			entry:    0x08000131,
+			hasEntry: true,
+			imgName:  "fw",
+		},
+		{
+			name:     "S8 entry",
+			src:      srecRecord('2', 0x4000, 1) + srecRecord('8', 0x4001),
+			targets:  []testTarget{{0x4000, []byte{1}}},
+			entry:    0x4001,
+			hasEntry: true,
+		},
+		{
+			name:    "bad checksum",
+			src:     srecRecord('1', 0, 1) + "S1040010020E\n",
+			errText: "line 2: checksum mismatch",
+		},
+		{
+			name:    "byte count mismatch",
+			src:     "S105001002E8\n",
+			errText: "line 1: record length",
+		},
+		{
+			name:    "unsupported record type",
+			src:     srecRecord('1', 0, 1) + "S4030000FC\n",
+			errText: "line 2: unsupported record type S4",
+		},
+		{
+			name:    "missing record start",
+			src:     ":00000001FF\n",
+			errText: "line 1: missing 'S'",
+		},
+		{
+			name:    "overlapping data",
+			src:     srecRecord('1', 0, 1, 2) + srecRecord('1', 1, 3),
+			errText: "Overlapping data",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			image, err := ParseSRec(strings.NewReader(test.src))
+
+			if test.errText != "" {
+				if err == nil || !strings.Contains(err.Error(), test.errText) {
+					t.Fatalf("expected an error containing %q, got %v", test.errText, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			checkTargets(t, image, test.targets)
+
+			if image.HasEntryAddress != test.hasEntry || image.EntryAddress != test.entry {
+				t.Errorf("expected entry 0x%x (%v), got 0x%x (%v)", test.entry, test.hasEntry, image.EntryAddress, image.HasEntryAddress)
+			}
+
+			name := strings.TrimRight(string(image.Prefix.Name[:]), "\x00")
+			if name != test.imgName || (image.Prefix.IsNamed != 0) != (test.imgName != "") {
+				t.Errorf("expected name %q, got %q (named %d)", test.imgName, name, image.Prefix.IsNamed)
+			}
+		})
+	}
+}
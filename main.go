@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/willtoth/go-dfuse/dfudevice"
@@ -57,8 +63,120 @@ func StartNew() consoleProgress {
 	return c
 }
 
+// loadFile picks a loader from the file extension, raw binaries take their
+// load address after an '@', e.g. firmware.bin@0x08000000. Formats other than
+// DfuSe are wrapped in a file holding a single image.
+func loadFile(filename string) (dfufile.DFUFile, error) {
+	var image dfufile.DFUImage
+	var err error
+
+	if idx := strings.LastIndex(filename, "@"); idx >= 0 && strings.ToLower(filepath.Ext(filename[:idx])) == ".bin" {
+		address, err := strconv.ParseUint(filename[idx+1:], 0, 32)
+
+		if err != nil {
+			return dfufile.DFUFile{}, fmt.Errorf("Bad load address for %s: %v", filename[:idx], err)
+		}
+
+		image, err = dfufile.ReadBinary(filename[:idx], uint32(address), 0)
+		return dfufile.DFUFile{Images: []dfufile.DFUImage{image}}, err
+	}
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".bin":
+		return dfufile.DFUFile{}, fmt.Errorf("Raw binaries need a load address, use %s@<address>", filename)
+	case ".hex", ".ihex":
+		image, err = dfufile.ReadHex(filename)
+	case ".s19", ".s28", ".s37", ".srec", ".mot":
+		image, err = dfufile.ReadSRec(filename)
+	case ".elf", ".axf", ".out":
+		image, err = dfufile.ReadELF(filename)
+	default:
+		dfu, err := dfufile.Read(filename)
+
+		if err == nil && len(dfu.Images) == 0 {
+			err = fmt.Errorf("No images found in %s", filename)
+		}
+
+		return dfu, err
+	}
+
+	return dfufile.DFUFile{Images: []dfufile.DFUImage{image}}, err
+}
+
 func main() {
-	deviceList := dfudevice.List()
+	eraseFlag := flag.String("erase", "page", "erase mode before writing: page, mass or none")
+	diffFlag := flag.Bool("diff", false, "skip erasing and writing pages that already match the image")
+	vidFlag := flag.Uint("vid", 0, "only use devices with this USB vendor id, 0 for any")
+	pidFlag := flag.Uint("pid", 0, "only use devices with this USB product id, 0 for any")
+	detachFlag := flag.Bool("detach", false, "switch the device picked by -vid/-pid from its application into DFU mode first")
+	timeoutFlag := flag.Duration("timeout", dfudevice.DefaultCommandTimeout, "fail a DFU command the device does not finish within this time")
+
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: go-dfuse.exe [options] [path] <dfuFile>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var options dfudevice.WriteOptions
+	options.Differential = *diffFlag
+
+	switch *eraseFlag {
+	case "page":
+		options.Erase = dfudevice.EraseModePages
+	case "mass":
+		options.Erase = dfudevice.EraseModeMass
+	case "none":
+		options.Erase = dfudevice.EraseModeNone
+	default:
+		fmt.Println("Unknown erase mode: ", *eraseFlag)
+		flag.Usage()
+		return
+	}
+
+	filter := dfudevice.DeviceFilter{VID: uint16(*vidFlag), PID: uint16(*pidFlag)}
+
+	//Ctrl-C stops waiting for a device to enumerate, and stops flashing
+	//cleanly leaving the device idle in DFU mode
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+
+	//Detaching restarts the application of a device, only do it to the one
+	//device picked by the filter
+	if *detachFlag {
+		if filter.VID == 0 && filter.PID == 0 {
+			fmt.Println("-detach needs -vid or -pid to pick the device to detach")
+			return
+		}
+
+		runtimeList := dfudevice.ListRuntime(filter)
+		if len(runtimeList) > 1 {
+			fmt.Println("More than one device in runtime mode matches, cannot pick one to detach:")
+			for _, path := range runtimeList {
+				fmt.Println(path)
+			}
+			return
+		}
+
+		for _, path := range runtimeList {
+			fmt.Println("Detaching ", path)
+
+			dev, err := dfudevice.DetachToDFUContext(ctx, path, 5*time.Second)
+			if err != nil {
+				fmt.Println("Failed to detach ", err)
+				return
+			}
+			dev.Close()
+		}
+	}
+
+	deviceList := dfudevice.ListFiltered(filter)
 	for _, dev := range deviceList {
 		fmt.Println(dev)
 	}
@@ -69,19 +187,20 @@ func main() {
 
 	var filename string
 	var path string
-	if len(os.Args) < 2 {
+	args := flag.Args()
+	if len(args) < 1 {
 		return
-	} else if len(os.Args) == 2 {
+	} else if len(args) == 1 {
 		if len(deviceList) > 1 {
-			fmt.Println("Usage: go-dfuse.exe <path> <dfuFile>")
+			flag.Usage()
 			fmt.Println("More than one device detected, must specify path")
 			return
 		}
-		filename = os.Args[1]
+		filename = args[0]
 		path = deviceList[0]
 	} else {
-		path = os.Args[1]
-		filename = os.Args[2]
+		path = args[0]
+		filename = args[1]
 	}
 
 	fmt.Println("Opening device...")
@@ -94,39 +213,79 @@ func main() {
 		return
 	}
 
+	dev.SetCommandTimeout(*timeoutFlag)
+
 	bar := StartNew()
 
 	dev.RegisterProgress(&bar)
 
 	fmt.Println("Deviced Opened, reading ", filename)
 
-	dfu, err := dfufile.Read(filename)
+	dfu, err := loadFile(filename)
 
 	if err != nil {
 		fmt.Println("DFU File Format Failed: ", err)
 		return
 	}
 
-	err = dfudevice.WriteImage(dfu.Images[0], dev)
+	results, err := dfudevice.WriteFileWithOptionsContext(ctx, dfu, dev, options)
+
+	fmt.Println("")
+	for _, result := range results {
+		for _, target := range result.Targets {
+			fmt.Printf("Alt %d target %d at 0x%08x: %d of %d bytes written, %d already matched\n",
+				result.AltSetting, target.Target, target.Address, target.BytesWritten, target.Size, target.BytesSkipped)
+		}
+	}
 
 	if err != nil {
 		fmt.Println("Write DFUFile Failed ", err)
 		return
 	}
 
-	verify, err := dfudevice.VerifyImage(dfu.Images[0], dev)
+	//Plain DFU devices that are not manifestation tolerant wait for a reset
+	//once the download is manifested and cannot be read back
+	functional := dev.FunctionalDescriptor()
+	if !functional.CanUpload() || (!dev.IsDfuSe() && !functional.ManifestationTolerant()) {
+		fmt.Println("Device cannot be read back, skipping verify")
+	} else {
+		verify, err := dfudevice.VerifyFileContext(ctx, dfu, dev)
 
-	if err != nil || verify == false {
-		fmt.Println("Failed to verify DFU Image: ", err)
-		return
+		if err != nil || verify == false {
+			fmt.Println("Failed to verify DFU Image: ", err)
+			return
+		}
 	}
 
-	err = dev.ExitDFU(uint(dfu.Images[0].Targets[0].Prefix.Address))
+	//Taken before leaving DFU mode to find the device once it restarted
+	info, infoErr := dev.Info()
+
+	err = dev.ExitDFU(uint(dfu.Images[0].StartAddress()))
 
-	if err != nil || verify == false {
+	if err != nil {
 		fmt.Println("Failed to exit DFU mode: ", err)
+		return
 	}
 
 	fmt.Println("")
+
+	if infoErr != nil {
+		fmt.Println("Image written, cannot wait for the device to restart: ", infoErr)
+		return
+	}
+
+	restarted, err := dfudevice.WaitForDeviceContext(ctx, info, 5*time.Second)
+
+	if err != nil {
+		fmt.Println("Image written, could not confirm the device restarted: ", err)
+		return
+	}
+
+	if restarted.Mode == dfudevice.DeviceModeDFU {
+		fmt.Println("Device restarted in DFU mode, the application did not start")
+		return
+	}
+
+	fmt.Println("Device restarted in", restarted.Mode, "mode")
 	fmt.Println("Success!")
 }